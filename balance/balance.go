@@ -0,0 +1,259 @@
+// Package balance implement load balancing and failover among target backends.
+package balance
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Strategy decide the order of backends to try for a session.
+type Strategy string
+
+// Strategies supported.
+const (
+	RoundRobin Strategy = "roundrobin"
+	Random     Strategy = "random"
+	LeastConn  Strategy = "leastconn"
+	Hash       Strategy = "hash" // consistent hashing on the session key.
+)
+
+// ParseStrategy return the strategy named s, empty for RoundRobin.
+func ParseStrategy(s string) (Strategy, error) {
+	switch st := Strategy(s); st {
+	case "":
+		return RoundRobin, nil
+	case RoundRobin, Random, LeastConn, Hash:
+		return st, nil
+	default:
+		return "", errors.Errorf("unknown balance strategy %q", s)
+	}
+}
+
+// Backend is a target address with health state.
+type Backend struct {
+	Addr string
+
+	active    int64 // atomic, live connections.
+	fails     int64 // atomic, consecutive failures.
+	downUntil int64 // atomic, unix nano.
+}
+
+// Active return the number of live connections.
+func (b *Backend) Active() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+// Up report whether the backend is considered healthy now.
+func (b *Backend) Up() bool {
+	return time.Now().UnixNano() >= atomic.LoadInt64(&b.downUntil)
+}
+
+// Pool keep backends by address, so health is shared by groups and kept when
+// groups are created again on config reload.
+type Pool struct {
+	mu       sync.Mutex
+	backends map[string]*Backend
+	groups   map[string]*Group
+
+	maxFails    int64 // atomic
+	failTimeout int64 // atomic, nanoseconds.
+}
+
+// NewPool return a pool marking a backend down for failTimeout after maxFails consecutive failures.
+func NewPool(maxFails uint, failTimeout time.Duration) *Pool {
+	p := &Pool{backends: make(map[string]*Backend), groups: make(map[string]*Group)}
+	p.SetOptions(maxFails, failTimeout)
+
+	return p
+}
+
+// SetOptions change the failure options.
+func (p *Pool) SetOptions(maxFails uint, failTimeout time.Duration) {
+	if maxFails == 0 {
+		maxFails = 1
+	}
+	atomic.StoreInt64(&p.maxFails, int64(maxFails))
+	atomic.StoreInt64(&p.failTimeout, int64(failTimeout))
+}
+
+// Group return the group of addrs with strategy, the same addrs and strategy return the same group.
+func (p *Pool) Group(strategy Strategy, addrs []string) *Group {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := string(strategy) + " " + strings.Join(addrs, ",")
+	if g, ok := p.groups[key]; ok {
+		return g
+	}
+
+	g := &Group{pool: p, strategy: strategy}
+	for _, addr := range addrs {
+		b, ok := p.backends[addr]
+		if !ok {
+			b = &Backend{Addr: addr}
+			p.backends[addr] = b
+		}
+		g.backends = append(g.backends, b)
+	}
+	p.groups[key] = g
+
+	return g
+}
+
+// Fail record a failure of b, it is marked down after max consecutive failures.
+func (p *Pool) Fail(b *Backend) {
+	if atomic.AddInt64(&b.fails, 1) >= atomic.LoadInt64(&p.maxFails) {
+		p.Down(b)
+	}
+}
+
+// Down mark b down for the fail timeout at once.
+func (p *Pool) Down(b *Backend) {
+	atomic.StoreInt64(&b.fails, atomic.LoadInt64(&p.maxFails))
+	atomic.StoreInt64(&b.downUntil, time.Now().Add(time.Duration(atomic.LoadInt64(&p.failTimeout))).UnixNano())
+}
+
+// Succeed record a success of b, it is marked up.
+func (p *Pool) Succeed(b *Backend) {
+	atomic.StoreInt64(&b.fails, 0)
+	atomic.StoreInt64(&b.downUntil, 0)
+}
+
+// Group is the backends of a target.
+type Group struct {
+	pool     *Pool
+	strategy Strategy
+	backends []*Backend
+	next     uint32 // atomic, round robin position.
+}
+
+// Probe dial every backend once with dial to update their health for active
+// checks, it returns the dial errors by address, nil for reachable.
+func (g *Group) Probe(dial func(addr string) (net.Conn, error)) map[string]error {
+	errs := make(map[string]error, len(g.backends))
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, b := range g.backends {
+		wg.Add(1)
+		go func(b *Backend) {
+			defer wg.Done()
+
+			c, err := dial(b.Addr)
+			if err == nil {
+				c.Close()
+				g.pool.Succeed(b)
+			} else {
+				g.pool.Down(b)
+			}
+
+			mu.Lock()
+			errs[b.Addr] = err
+			mu.Unlock()
+		}(b)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// Picker return the picker of a session, key is the identity for Hash strategy.
+func (g *Group) Picker(key string) *Picker {
+	return &Picker{group: g, key: key}
+}
+
+// order return the backends in the order to try, healthy ones first.
+func (g *Group) order(key string) []*Backend {
+	n := len(g.backends)
+	list := make([]*Backend, n)
+	switch g.strategy {
+	case Random:
+		for i, j := range rand.Perm(n) {
+			list[i] = g.backends[j]
+		}
+	case LeastConn:
+		start := int(atomic.AddUint32(&g.next, 1)) % n
+		for i := range list {
+			list[i] = g.backends[(start+i)%n]
+		}
+		sort.SliceStable(list, func(i, j int) bool { return list[i].Active() < list[j].Active() })
+	case Hash:
+		// rendezvous hashing: keys move only when their top backend changes.
+		copy(list, g.backends)
+		scores := make(map[*Backend]uint64, n)
+		for _, b := range list {
+			h := fnv.New64a()
+			h.Write([]byte(key + "\x00" + b.Addr))
+			scores[b] = h.Sum64()
+		}
+		sort.Slice(list, func(i, j int) bool { return scores[list[i]] > scores[list[j]] })
+	default:
+		start := int(atomic.AddUint32(&g.next, 1)-1) % n
+		for i := range list {
+			list[i] = g.backends[(start+i)%n]
+		}
+	}
+
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Up() && !list[j].Up() })
+	return list
+}
+
+// Picker dial a backend of the group for a session.
+type Picker struct {
+	group *Group
+	key   string
+}
+
+// DialBackend dial backends in order of the strategy with dial, failing over to the
+// next when dial fails, down backends are tried after healthy ones.
+func (p *Picker) DialBackend(dial func(addr string) (net.Conn, error)) (net.Conn, error) {
+	pool := p.group.pool
+
+	var errs []string
+	for _, b := range p.group.order(p.key) {
+		c, err := dial(b.Addr)
+		if err != nil {
+			pool.Fail(b)
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		pool.Succeed(b)
+		atomic.AddInt64(&b.active, 1)
+		return &conn{Conn: c, backend: b}, nil
+	}
+
+	return nil, errors.Errorf("all backends failed: %s", strings.Join(errs, "; "))
+}
+
+// conn decrease the live connections of backend on close.
+type conn struct {
+	net.Conn
+	backend *Backend
+	once    sync.Once
+}
+
+// TargetAddr return the address the backend resolved to, see tcpb.Bridge.Dialer.
+func (c *conn) TargetAddr() net.Addr {
+	if tc, ok := c.Conn.(interface{ TargetAddr() net.Addr }); ok {
+		return tc.TargetAddr()
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.backend.active, -1) })
+
+	return c.Conn.Close()
+}
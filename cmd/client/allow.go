@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+
+	"github.com/wuhuizuo/tcpb/cmd/internal/ipnet"
+	"github.com/wuhuizuo/tcpb/cmd/internal/metrics"
+	"github.com/wuhuizuo/tcpb/logging"
+)
+
+var rejectedSource = metrics.NewCounter(`tcpb_rejected_connections_total{reason="source"}`, "Accepted connections or datagrams rejected by the source allowlist.")
+
+// allowSource report whether the source address is allowed by sources, unix
+// socket peers are always allowed as they are protected by file permissions.
+func allowSource(addr net.Addr, sources ipnet.Nets) bool {
+	if len(sources) == 0 {
+		return true
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return true
+	}
+
+	return sources.Allow(ip)
+}
+
+// allowPacketConn drop datagrams from sources not allowed.
+type allowPacketConn struct {
+	net.PacketConn
+	sources ipnet.Nets
+}
+
+// ReadFrom implement net.PacketConn, it returns only datagrams from allowed sources.
+func (c *allowPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || allowSource(addr, c.sources) {
+			return n, addr, err
+		}
+
+		// datagrams may flood, log them at debug level.
+		logging.Default().Log(logging.LevelDebug, "reject datagram", "from", addr, "reason", "source ip not allowed")
+		rejectedSource.Inc()
+	}
+}
@@ -1,8 +1,18 @@
 package main
 
 import (
+	"flag"
 	"net/http"
 	"net/url"
+
+	"github.com/wuhuizuo/tcpb/cmd/internal/cfgfile"
+	"github.com/wuhuizuo/tcpb/cmd/internal/ipnet"
+	"github.com/wuhuizuo/tcpb/logging"
+	"github.com/wuhuizuo/tcpb/proxy/poll"
+	ws "github.com/wuhuizuo/tcpb/proxy/websocket"
+	"github.com/wuhuizuo/tcpb/resolve"
+	"github.com/wuhuizuo/tcpb/throttle"
+	netproxy "golang.org/x/net/proxy"
 )
 
 type proxyGetter func(*http.Request) (*url.URL, error)
@@ -12,13 +22,208 @@ type clientCfg struct {
 
 	listenHost string
 	listenPort uint
+	listenUnix string
+	udp        bool
+
+	acceptProxyProtocol bool
+	allowSources        cfgfile.StringList
+
+	resolveHosts  cfgfile.StringList
+	dnsServer     string
+	dohURL        string
+	ipFamily      string
+	happyEyeballs bool
+
+	bandwidthSessionUp    int64
+	bandwidthSessionDown  int64
+	bandwidthListenerUp   int64
+	bandwidthListenerDown int64
+	adminAddr             string
+
+	logLevel  string
+	logFormat string
 }
 
 type clientTunnelCfg struct {
 	tunnelURL  string
+	vias       cfgfile.StringList
 	httpMethod string
+	http2      bool
 
 	proxyURL string
 
 	heartbeatInterval uint
+	udpIdleTimeout    uint
+	idleTimeout       uint
+
+	compression        bool
+	compressionLevel   int
+	compressionMinSize uint
+
+	dialer netproxy.ContextDialer // dialer reaching the last hop with resolving and previous hops, nil for default.
+}
+
+// resolveConfig return the resolving of tunnel and proxy hosts.
+func (c *clientCfg) resolveConfig() resolve.Config {
+	return resolve.Config{
+		Hosts:         c.resolveHosts,
+		DNSServer:     c.dnsServer,
+		DoHURL:        c.dohURL,
+		Family:        c.ipFamily,
+		HappyEyeballs: c.happyEyeballs,
+	}
+}
+
+// wsCompression return the compression of websocket tunnels.
+func (c *clientTunnelCfg) wsCompression() ws.Compression {
+	return ws.Compression{Enabled: c.compression, Level: c.compressionLevel, MinSize: int(c.compressionMinSize)}
+}
+
+// targetURL return the url of the last hop which carries the tunnel target.
+func (c *clientTunnelCfg) targetURL() string {
+	if len(c.vias) > 0 {
+		return c.vias[len(c.vias)-1]
+	}
+
+	return c.tunnelURL
+}
+
+// bindFlags define flags of config in fs, flag names are also the keys of config file.
+func bindFlags(fs *flag.FlagSet, config *clientCfg) {
+	fs.StringVar(&config.listenHost, "host", "", "The ip to bind on, default all")
+	fs.UintVar(&config.listenPort, "port", 0, "The port to listen on, default automatically chosen.")
+	fs.UintVar(&config.heartbeatInterval, "heartbeat", 30, "The interval(second) for heartbeat sending to tunnel server.")
+	fs.StringVar(&config.listenUnix, "unix", "", "The unix socket path to listen on instead of tcp host and port")
+	fs.BoolVar(&config.acceptProxyProtocol, "accept-proxy-protocol", false, "require a PROXY protocol v1/v2 header on accepted tcp connections when behind a load balancer")
+	fs.Var(&config.allowSources, "allow-source", "The CIDR or ip of sources allowed to use the tunnel, repeat for more, all allowed when not set, not checked for unix socket")
+	fs.BoolVar(&config.udp, "udp", false, "forward udp instead of tcp, only for websocket tunnel url with target path format: udp:host:port")
+	fs.UintVar(&config.udpIdleTimeout, "udp-timeout", 60, "The idle timeout(second) for udp sessions of every source address.")
+	fs.UintVar(&config.idleTimeout, "idle-timeout", 0, "The idle timeout(second) for tcp connections without payload in either direction, heartbeats not counted, 0 for never.")
+	fs.BoolVar(&config.compression, "compression", false, "offer websocket permessage-deflate compression to the tunnel server, used when it accepts")
+	fs.IntVar(&config.compressionLevel, "compression-level", ws.DefaultCompressionLevel, "The flate level of websocket compression from -2(huffman only) to 9(best compression)")
+	fs.UintVar(&config.compressionMinSize, "compression-min-size", 0, "The min message size(byte) to compress, smaller messages are sent uncompressed")
+	fs.StringVar(&config.tunnelURL, "tunnel", "", "tunnel url, format: (ws|http|https)://[user:name@]host:port[/path]")
+	fs.Var(&config.vias, "via", "The next tunnel url to chain after the tunnel, repeat for more hops in order: every hop is dialed through the tunnel of the previous one, the last url carries the target path, paths of the previous hops default to the address of the next hop, proxy is not used with hops")
+	fs.Var(&config.resolveHosts, "resolve", "The static address of a tunnel or proxy host in format host=ip, repeat for more hosts or addresses")
+	fs.StringVar(&config.dnsServer, "dns-server", "", "The DNS server host[:port] to resolve tunnel and proxy hosts, default the system resolver")
+	fs.StringVar(&config.dohURL, "doh-url", "", "The DNS-over-HTTPS url to resolve tunnel and proxy hosts like https://1.1.1.1/dns-query, it has priority over dns-server")
+	fs.StringVar(&config.ipFamily, "ip-family", resolve.FamilyAny, "The ip family to dial tunnel and proxy hosts: any|ip4|ip6")
+	fs.BoolVar(&config.happyEyeballs, "happy-eyeballs", false, "race the addresses of tunnel and proxy hosts alternating ipv6 and ipv4 instead of trying them one by one")
+	fs.StringVar(&config.proxyURL, "proxy", "", "proxy url, format: http[s]://[user:name@]host:port[/path], default use system proxy.")
+	fs.StringVar(&config.httpMethod, "method", http.MethodPost, "http proxy method: POST|CONNECT|POLL, only for http/https tunnel url, POLL splits upload/download into short requests for buffering proxies")
+	fs.StringVar(&config.logLevel, "log-level", "info", "The log level: debug|info|warn|error")
+	fs.StringVar(&config.logFormat, "log-format", "text", "The log format: text|json")
+	fs.Int64Var(&config.bandwidthSessionUp, "bandwidth-session-up", 0, "The max bytes per second to tunnel of every connection, 0 for unlimited")
+	fs.Int64Var(&config.bandwidthSessionDown, "bandwidth-session-down", 0, "The max bytes per second from tunnel of every connection, 0 for unlimited")
+	fs.Int64Var(&config.bandwidthListenerUp, "bandwidth-up", 0, "The max bytes per second to tunnel of all connections on the listener, 0 for unlimited")
+	fs.Int64Var(&config.bandwidthListenerDown, "bandwidth-down", 0, "The max bytes per second from tunnel of all connections on the listener, 0 for unlimited")
+	fs.StringVar(&config.adminAddr, "admin-addr", "", "The address for admin http api like 127.0.0.1:9091, disabled when empty")
+	fs.BoolVar(&config.http2, "h2", false, "tunnel every connection as a stream on a shared HTTP/2 connection: POST stream for http(s), extended CONNECT for wss with HTTP/1.1 upgrade fallback")
+}
+
+// bandwidthRates return the bandwidth of connections, shared rates are aggregated by listener.
+func (c *clientCfg) bandwidthRates() throttle.Rates {
+	return throttle.Rates{
+		SessionUp:   c.bandwidthSessionUp,
+		SessionDown: c.bandwidthSessionDown,
+		SharedUp:    c.bandwidthListenerUp,
+		SharedDown:  c.bandwidthListenerDown,
+	}
+}
+
+// validate check the config, errors are located in config file when the option set there.
+func (c *clientCfg) validate(file *cfgfile.File) error {
+	if c.tunnelURL == "" {
+		return file.Errorf("tunnel", "tunnel url is required")
+	}
+	u, err := url.Parse(c.tunnelURL)
+	if err != nil {
+		return file.Errorf("tunnel", "%s", err)
+	}
+	switch u.Scheme {
+	case "ws", "wss", "http", "https", "socks5":
+	default:
+		return file.Errorf("tunnel", "unsupported scheme %q", u.Scheme)
+	}
+	if u.Scheme == "socks5" && len(c.vias) > 0 {
+		return file.Errorf("via", "socks5 tunnel can not be chained")
+	}
+
+	for _, via := range c.vias {
+		hop, err := url.Parse(via)
+		if err != nil {
+			return file.Errorf("via", "%s", err)
+		}
+		switch hop.Scheme {
+		case "ws", "wss", "http", "https":
+		default:
+			return file.Errorf("via", "unsupported scheme %q", hop.Scheme)
+		}
+		u = hop
+	}
+
+	if err := c.wsCompression().Validate(); err != nil {
+		return file.Errorf("compression-level", "%s", err)
+	}
+
+	if _, err := resolve.ParseHosts(c.resolveHosts); err != nil {
+		return file.Errorf("resolve", "%s", err)
+	}
+	if _, err := resolve.ParseFamily(c.ipFamily); err != nil {
+		return file.Errorf("ip-family", "%s", err)
+	}
+	rc := c.resolveConfig()
+	if _, err := rc.NewDialer(nil, nil); err != nil {
+		return file.Errorf("doh-url", "%s", err)
+	}
+
+	switch c.httpMethod {
+	case http.MethodPost, http.MethodConnect, poll.Method:
+	default:
+		return file.Errorf("method", "unsupported method %q", c.httpMethod)
+	}
+
+	switch c.proxyURL {
+	case proxyNone, proxyEnv, "":
+	default:
+		if _, err := url.ParseRequestURI(c.proxyURL); err != nil {
+			return file.Errorf("proxy", "%s", err)
+		}
+	}
+
+	if _, err := ipnet.Parse(c.allowSources); err != nil {
+		return file.Errorf("allow-source", "%s", err)
+	}
+
+	if c.listenUnix != "" && c.udp {
+		return file.Errorf("udp", "udp can not listen on unix socket")
+	}
+	if c.udp && u.Scheme != "ws" && u.Scheme != "wss" {
+		return file.Errorf("udp", "udp forwarding only supported with websocket tunnel")
+	}
+	if c.listenPort > 65535 {
+		return file.Errorf("port", "port out of range: %d", c.listenPort)
+	}
+
+	for name, v := range map[string]int64{
+		"bandwidth-session-up":   c.bandwidthSessionUp,
+		"bandwidth-session-down": c.bandwidthSessionDown,
+		"bandwidth-up":           c.bandwidthListenerUp,
+		"bandwidth-down":         c.bandwidthListenerDown,
+	} {
+		if v < 0 {
+			return file.Errorf(name, "bandwidth should not be negative")
+		}
+	}
+
+	if _, err := logging.ParseLevel(c.logLevel); err != nil {
+		return file.Errorf("log-level", "%s", err)
+	}
+	switch logging.Format(c.logFormat) {
+	case logging.FormatText, logging.FormatJSON:
+	default:
+		return file.Errorf("log-format", "unknown log format %q", c.logFormat)
+	}
+
+	return nil
 }
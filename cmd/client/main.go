@@ -4,7 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
@@ -14,7 +14,16 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/wuhuizuo/tcpb"
+	"github.com/wuhuizuo/tcpb/cmd/internal/admin"
+	"github.com/wuhuizuo/tcpb/cmd/internal/cfgfile"
+	"github.com/wuhuizuo/tcpb/cmd/internal/ipnet"
+	"github.com/wuhuizuo/tcpb/cmd/internal/metrics"
+	"github.com/wuhuizuo/tcpb/logging"
 	"github.com/wuhuizuo/tcpb/proxy"
+	"github.com/wuhuizuo/tcpb/proxyproto"
+	"github.com/wuhuizuo/tcpb/resolve"
+	"github.com/wuhuizuo/tcpb/throttle"
+	netproxy "golang.org/x/net/proxy"
 )
 
 // proxy types
@@ -25,6 +34,12 @@ const (
 	errCodeArgInvalid = -2
 )
 
+// bandwidth throttle sessions, shared rates are aggregated by listener.
+var bandwidth = throttle.NewPolicy(throttle.Rates{})
+
+// key of sessions aggregated by listener in bandwidth.
+const listenerKey = "listener"
+
 // release version info
 var (
 	version   string = "unknown"
@@ -33,8 +48,11 @@ var (
 
 func main() {
 	config, err := parseCmdArgs()
+	if err == nil {
+		err = setupLogging(config.logLevel, config.logFormat)
+	}
 	if err != nil {
-		log.Printf("[ERROR] %s", err)
+		logging.Default().Log(logging.LevelError, "invalid arguments", "err", err)
 		os.Exit(errCodeArgInvalid)
 	}
 	c := make(chan os.Signal, 1)
@@ -42,28 +60,41 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		oscall := <-c
-		log.Printf("[WARN ] system call:%+v", oscall)
+		logging.Default().Log(logging.LevelWarn, "system call", "signal", oscall)
 		cancel()
 	}()
 
 	if err := serve(ctx, *config); err != nil {
-		log.Printf("[ERROR] failed to serve:+%v\n", err)
+		logging.Default().Log(logging.LevelError, "failed to serve", "err", err)
 		os.Exit(1)
 	}
 
-	log.Println("[WARN ] exit normally.")
+	logging.Default().Log(logging.LevelWarn, "exit normally")
 	os.Exit(0)
 }
 
+// setupLogging set the default logger with level and format from command line.
+func setupLogging(level, format string) error {
+	lvl, err := logging.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	logger, err := logging.New(os.Stdout, logging.Format(format), lvl)
+	if err != nil {
+		return err
+	}
+	logging.SetDefault(logger)
+
+	return nil
+}
+
 func parseCmdArgs() (*clientCfg, error) {
 	var config clientCfg
-	flag.StringVar(&config.listenHost, "host", "", "The ip to bind on, default all")
-	flag.UintVar(&config.listenPort, "port", 0, "The port to listen on, default automatically chosen.")
-	flag.UintVar(&config.heartbeatInterval, "heartbeat", 30, "The interval(second) for heartbeat sending to tunnel server.")
-	flag.StringVar(&config.tunnelURL, "tunnel", "", "tunnel url, format: (ws|http|https)://[user:name@]host:port[/path]")
-	flag.StringVar(&config.proxyURL, "proxy", "", "proxy url, format: http[s]://[user:name@]host:port[/path], default use system proxy.")
-	flag.StringVar(&config.httpMethod, "method", http.MethodPost, "http proxy method: POST|CONNECT, only for http/https tunnel url")
+	bindFlags(flag.CommandLine, &config)
 
+	configFile := flag.String("config", "", "The config file path, TOML format with flag names as keys, flags on command line override file values")
+	printConfig := flag.Bool("print-config", false, "prints the effective configuration with passwords masked and exit")
 	showVersion := flag.Bool("version", false, "prints current version")
 	flag.Usage = usage
 
@@ -74,34 +105,79 @@ func parseCmdArgs() (*clientCfg, error) {
 		os.Exit(0)
 	}
 
+	file, err := cfgfile.ApplyFile(flag.CommandLine, *configFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.validate(file); err != nil {
+		return nil, err
+	}
+
+	if *printConfig {
+		if err := cfgfile.Dump(os.Stdout, flag.CommandLine, nil, "config", "print-config", "version"); err != nil {
+			return nil, err
+		}
+		os.Exit(0)
+	}
+
 	return &config, nil
 }
 
 func serve(ctx context.Context, cfg clientCfg) error {
-	if err := registryProxy(cfg); err != nil {
+	if err := registryProxy(&cfg); err != nil {
 		return errors.WithStack(err)
 	}
 
-	l, err := net.Listen("tcp", net.JoinHostPort(cfg.listenHost, fmt.Sprint(cfg.listenPort)))
+	bandwidth.SetRates(cfg.bandwidthRates())
+	if cfg.adminAddr != "" {
+		api := admin.New()
+		api.Handle("/bandwidth", admin.BandwidthHandler(bandwidth))
+		api.Handle("/metrics", metrics.Handler())
+		if err := api.Start(cfg.adminAddr); err != nil {
+			return err
+		}
+	}
+
+	if cfg.udp {
+		return serveUDP(ctx, cfg)
+	}
+
+	l, err := listen(cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.acceptProxyProtocol {
+		l = proxyproto.NewListener(l)
+	}
+	sources, err := ipnet.Parse(cfg.allowSources)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("[INFO ] TCP tunnel started on %s [%s]\n", l.Addr().String(), l.Addr().Network())
+	logger := logging.Default()
+	logger.Log(logging.LevelInfo, "tcp tunnel started", "addr", l.Addr(), "network", l.Addr().Network())
 	go func() {
 		for {
 			c, err := l.Accept()
 			if err != nil {
-				log.Fatalf("[ERROR] accept connection failed: %+v\n", err)
+				logger.Log(logging.LevelError, "accept connection failed", "err", err)
+				os.Exit(1)
 			}
-			log.Printf("[INFO ] accepted connection %s -> %s\n", c.RemoteAddr(), c.LocalAddr())
-
-			go handleConnection(c, cfg.clientTunnelCfg)
+			go func() {
+				// checked out of the accept loop, the address may wait for a PROXY header.
+				if !allowSource(c.RemoteAddr(), sources) {
+					logger.Log(logging.LevelWarn, "reject connection", "from", c.RemoteAddr(), "to", c.LocalAddr(), "reason", "source ip not allowed")
+					rejectedSource.Inc()
+					c.Close()
+					return
+				}
+				handleConnection(c, cfg.clientTunnelCfg)
+			}()
 		}
 	}()
 
 	<-ctx.Done()
-	log.Printf("[INFO ] TCP tunnel stopping on %s [%s]\n", l.Addr().String(), l.Addr().Network())
+	logger.Log(logging.LevelInfo, "tcp tunnel stopping", "addr", l.Addr(), "network", l.Addr().Network())
 
 	_, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer func() {
@@ -109,16 +185,69 @@ func serve(ctx context.Context, cfg clientCfg) error {
 	}()
 
 	if err = l.Close(); err != nil {
-		log.Printf("[ERROR] %s\n", err)
 		return errors.Wrap(err, "server shutdown failed.")
 	}
 
-	log.Println("[INFO ] TCP tunnel stopped.")
+	logger.Log(logging.LevelInfo, "tcp tunnel stopped")
+	return nil
+}
+
+// listen on unix socket path or tcp host and port.
+func listen(cfg clientCfg) (net.Listener, error) {
+	if cfg.listenUnix == "" {
+		return net.Listen("tcp", net.JoinHostPort(cfg.listenHost, fmt.Sprint(cfg.listenPort)))
+	}
+
+	// remove the stale socket file left by previous process.
+	if fi, err := os.Stat(cfg.listenUnix); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(cfg.listenUnix); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return net.Listen("unix", cfg.listenUnix)
+}
+
+func serveUDP(ctx context.Context, cfg clientCfg) error {
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(cfg.listenHost, fmt.Sprint(cfg.listenPort)))
+	if err != nil {
+		return err
+	}
+	sources, err := ipnet.Parse(cfg.allowSources)
+	if err != nil {
+		return err
+	}
+	if len(sources) > 0 {
+		pc = &allowPacketConn{PacketConn: pc, sources: sources}
+	}
+
+	logger := logging.Default()
+	logger.Log(logging.LevelInfo, "udp tunnel started", "addr", pc.LocalAddr(), "network", pc.LocalAddr().Network())
+	go func() {
+		// all udp sessions of the listener share the tunnel bridge.
+		bridge := newBridge(cfg.clientTunnelCfg)
+		bw, release := bandwidth.Session(listenerKey)
+		defer release()
+		bridge.Bandwidth = bw
+		if err := bridge.ServeUDP(pc, cfg.targetURL()); err != nil {
+			logger.Log(logging.LevelError, "udp forwarding stopped", "err", err)
+		}
+	}()
+
+	<-ctx.Done()
+	logger.Log(logging.LevelInfo, "udp tunnel stopping", "addr", pc.LocalAddr(), "network", pc.LocalAddr().Network())
+
+	if err = pc.Close(); err != nil {
+		return errors.Wrap(err, "server shutdown failed.")
+	}
+
+	logger.Log(logging.LevelInfo, "udp tunnel stopped")
 	return nil
 }
 
-// registry tcp proxy on http dialer.
-func registryProxy(cfg clientCfg) error {
+// registry tcp proxy on http dialer, and set up the dialer resolving hosts and
+// chaining the hops before the last one.
+func registryProxy(cfg *clientCfg) error {
 	tunnelURI, err := url.Parse(cfg.tunnelURL)
 	if err != nil {
 		return errors.WithStack(err)
@@ -126,27 +255,91 @@ func registryProxy(cfg clientCfg) error {
 
 	proxyCfg := proxy.DefaultConfig(tunnelURI)
 	proxyCfg.HTTPMethod = cfg.httpMethod
+	proxyCfg.HTTP2 = cfg.http2
 	proxyCfg.WSHeartInterval = time.Duration(cfg.heartbeatInterval) * time.Second
+	proxyCfg.WSCompression = cfg.wsCompression()
 
 	proxy.RegisterProxyDialer(proxyCfg)
 
+	var first netproxy.Dialer = netproxy.FromEnvironment()
+	forward, err := resolveDialer(cfg)
+	if err != nil {
+		return err
+	}
+	if forward != nil {
+		cfg.dialer, first = forward, forward
+	}
+
+	if len(cfg.vias) == 0 {
+		return nil
+	}
+	// the last hop is dialed by the bridge through the previous ones.
+	hops := []*url.URL{tunnelURI}
+	for _, via := range cfg.vias[:len(cfg.vias)-1] {
+		hop, err := url.Parse(via)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		hops = append(hops, hop)
+	}
+
+	d, err := proxy.Chain(hops, first, proxyCfg)
+	if err != nil {
+		return err
+	}
+	cfg.dialer = proxy.WithContext(d)
+
 	return nil
 }
 
+// resolveDialer return the dialer resolving tunnel and proxy hosts by config, nil
+// for system resolving.
+func resolveDialer(cfg *clientCfg) (*resolve.Dialer, error) {
+	rc := cfg.resolveConfig()
+	if rc.Empty() {
+		return nil, nil
+	}
+
+	return rc.NewDialer(proxy.WithContext(netproxy.FromEnvironment()), nil)
+}
+
 func handleConnection(c net.Conn, tunnelCfg clientTunnelCfg) {
+	logging.Default().Log(logging.LevelInfo, "accepted connection", "from", c.RemoteAddr(), "to", c.LocalAddr())
 	defer func() {
-		log.Printf("[WARN ] close client tcp connection: %s -> %s \n", c.LocalAddr(), c.RemoteAddr())
+		logging.Default().Log(logging.LevelInfo, "close client connection", "from", c.LocalAddr(), "to", c.RemoteAddr())
 		c.Close()
 	}()
 
-	bridge := tcpb.Bridge{
-		WSProxyGetter: getWSProxy(tunnelCfg.proxyURL),
-		HeartInterval: time.Duration(tunnelCfg.heartbeatInterval) * time.Second,
-	}
+	bw, release := bandwidth.Session(listenerKey)
+	defer release()
 
-	err := bridge.TCP2Tunnel(c, tunnelCfg.tunnelURL)
+	bridge := newBridge(tunnelCfg)
+	bridge.Bandwidth = bw
+	err := bridge.TCP2Tunnel(c, tunnelCfg.targetURL())
 	if err != nil {
-		log.Printf("[ERROR] %+v\n", err)
+		logging.Default().Log(logging.LevelError, "tunnel failed", "err", err)
+	}
+}
+
+func newBridge(tunnelCfg clientTunnelCfg) *tcpb.Bridge {
+	wsProxy := getWSProxy(tunnelCfg.proxyURL)
+	if len(tunnelCfg.vias) > 0 {
+		wsProxy = nil
+	}
+
+	return &tcpb.Bridge{
+		Dialer:         tunnelCfg.dialer,
+		WSProxyGetter:  wsProxy,
+		HeartInterval:  time.Duration(tunnelCfg.heartbeatInterval) * time.Second,
+		HTTP2:          tunnelCfg.http2,
+		Compression:    tunnelCfg.wsCompression(),
+		UDPIdleTimeout: time.Duration(tunnelCfg.udpIdleTimeout) * time.Second,
+		IdleTimeout:    time.Duration(tunnelCfg.idleTimeout) * time.Second,
+		OnSessionEnd: func(st tcpb.Stats) {
+			logging.Default().Log(logging.LevelInfo, "session ended", "tunnel", st.Target,
+				"up", st.Up, "down", st.Down, "duration", st.Duration.Round(time.Millisecond), "reason", st.Reason,
+				"protocol", st.Version, "compression", math.Round(st.Compression*100)/100)
+		},
 	}
 }
 
@@ -169,12 +362,9 @@ func getWSProxy(proxy string) proxyGetter {
 	default:
 		proxyURI, err := url.ParseRequestURI(proxy)
 		if err != nil {
-			log.Fatalln("[ERROR] proxy url invalid", err)
+			logging.Default().Log(logging.LevelError, "proxy url invalid", "url", proxy, "err", err)
+			os.Exit(errCodeArgInvalid)
 		}
 		return http.ProxyURL(proxyURI)
 	}
 }
-
-func init() {
-	log.SetOutput(os.Stdout)
-}
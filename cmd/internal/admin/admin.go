@@ -0,0 +1,72 @@
+// Package admin implement the admin http api of commands, it should listen on a private address.
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/wuhuizuo/tcpb/logging"
+	"github.com/wuhuizuo/tcpb/throttle"
+)
+
+// Server is the admin http api server.
+type Server struct {
+	mux *http.ServeMux
+}
+
+// New return an admin server without any api.
+func New() *Server {
+	return &Server{mux: http.NewServeMux()}
+}
+
+// Handle register the handler for pattern.
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
+// Start listen on addr and serve in background.
+func (s *Server) Start(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	logging.Default().Log(logging.LevelInfo, "admin api listening", "addr", l.Addr())
+	go func() {
+		if err := http.Serve(l, s.mux); err != nil {
+			logging.Default().Log(logging.LevelError, "admin api stopped", "err", err)
+		}
+	}()
+
+	return nil
+}
+
+// BandwidthHandler serve the bandwidth rates of p: GET return the rates, PUT or
+// POST with a json object change them, omitted fields are kept.
+func BandwidthHandler(p *throttle.Policy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			rates := p.Rates()
+			if err := json.NewDecoder(r.Body).Decode(&rates); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if rates.SessionUp < 0 || rates.SessionDown < 0 || rates.SharedUp < 0 || rates.SharedDown < 0 {
+				http.Error(w, "rates should not be negative", http.StatusBadRequest)
+				return
+			}
+			p.SetRates(rates)
+			logging.Default().Log(logging.LevelInfo, "bandwidth changed", "session_up", rates.SessionUp, "session_down", rates.SessionDown, "shared_up", rates.SharedUp, "shared_down", rates.SharedDown)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(p.Rates())
+	})
+}
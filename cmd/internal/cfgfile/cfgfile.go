@@ -0,0 +1,478 @@
+// Package cfgfile load command options from a TOML file, keys are the command flag names.
+//
+// Only the subset of TOML needed for flags is supported:
+//
+//	# comment
+//	port = 8080
+//	tunnel = "ws://127.0.0.1:8080/127.0.0.1:22"
+//	h2 = true
+//	user = ["alice:secret", "bob:secret"] # repeated flag
+//
+//	[log]            # keys in table are prefixed: log-level, log-format
+//	level = "debug"
+//
+// Underscores in keys are the same as dashes, so `udp_timeout` set the flag `-udp-timeout`.
+package cfgfile
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Entry is an option set in the config file.
+type Entry struct {
+	Key    string   // flag name.
+	Values []string // more than one value only for arrays.
+	Array  bool
+	Line   int
+}
+
+// File is a parsed config file.
+type File struct {
+	Path    string
+	Entries []Entry
+}
+
+// Load read and parse the config file at path.
+func Load(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	return Parse(path, f)
+}
+
+// Parse parse config from r, path is only used in error messages.
+func Parse(path string, r io.Reader) (*File, error) {
+	file := &File{Path: path}
+	seen := make(map[string]int)
+
+	var (
+		prefix    string
+		pending   string // unterminated array spanning lines.
+		startLine int
+	)
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if pending != "" {
+			pending += " " + line
+			if !arrayClosed(pending) {
+				continue
+			}
+			line, pending = pending, ""
+		} else {
+			startLine = lineNo
+		}
+
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && !strings.Contains(line, "=") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, file.lineError(startLine, "invalid table header: %s", line)
+			}
+			prefix = normalizeKey(strings.Replace(strings.TrimSpace(line[1:len(line)-1]), ".", "-", -1))
+			if prefix == "" {
+				return nil, file.lineError(startLine, "empty table name")
+			}
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, file.lineError(startLine, "expected key = value: %s", line)
+		}
+		key, err := parseKey(strings.TrimSpace(line[:eq]))
+		if err != nil {
+			return nil, file.lineError(startLine, "%s", err)
+		}
+		if prefix != "" {
+			key = prefix + "-" + key
+		}
+
+		raw := strings.TrimSpace(line[eq+1:])
+		if strings.HasPrefix(raw, "[") && !arrayClosed(raw) {
+			pending = line
+			continue
+		}
+
+		if prev, ok := seen[key]; ok {
+			return nil, file.lineError(startLine, "duplicated option %q, first set at line %d", key, prev)
+		}
+		seen[key] = startLine
+
+		entry, err := parseEntry(key, raw, startLine)
+		if err != nil {
+			return nil, file.lineError(startLine, "%s", err)
+		}
+		file.Entries = append(file.Entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if pending != "" {
+		return nil, file.lineError(startLine, "unterminated array")
+	}
+
+	return file, nil
+}
+
+// Apply set flags of fs from the file, flags already set on command line are kept.
+func (f *File) Apply(fs *flag.FlagSet) error {
+	if f == nil {
+		return nil
+	}
+
+	onCmdLine := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) { onCmdLine[fl.Name] = true })
+
+	for i := range f.Entries {
+		e := &f.Entries[i]
+		fl := fs.Lookup(e.Key)
+		if fl == nil {
+			return f.lineError(e.Line, "unknown option %q", e.Key)
+		}
+		if onCmdLine[e.Key] {
+			continue
+		}
+
+		_, repeated := fl.Value.(*StringList)
+		if e.Array && !repeated {
+			return f.lineError(e.Line, "option %q does not accept an array", e.Key)
+		}
+		for _, v := range e.Values {
+			if err := fs.Set(e.Key, v); err != nil {
+				return f.lineError(e.Line, "invalid value %q for %q: %s", v, e.Key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Errorf return an error about option name, it is located with the file line when
+// the option is set in the file.
+func (f *File) Errorf(name, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if f != nil {
+		for _, e := range f.Entries {
+			if e.Key == name {
+				return f.lineError(e.Line, "%s: %s", name, msg)
+			}
+		}
+	}
+
+	return errors.Errorf("-%s: %s", name, msg)
+}
+
+func (f *File) lineError(line int, format string, args ...interface{}) error {
+	return errors.Errorf("%s:%d: %s", f.Path, line, fmt.Sprintf(format, args...))
+}
+
+// Dump write the effective value of all flags in fs as a config file, flags in skip are
+// omitted. Secrets are masked: passwords in urls and in the name:password values of
+// the credentials flags.
+func Dump(w io.Writer, fs *flag.FlagSet, credentials []string, skip ...string) error {
+	skipped := make(map[string]bool)
+	for _, s := range skip {
+		skipped[s] = true
+	}
+	secret := make(map[string]bool)
+	for _, s := range credentials {
+		secret[s] = true
+	}
+
+	var buf bytes.Buffer
+	fs.VisitAll(func(fl *flag.Flag) {
+		if skipped[fl.Name] {
+			return
+		}
+		redact := redactURL
+		if secret[fl.Name] {
+			redact = redactCredential
+		}
+		fmt.Fprintf(&buf, "%s = %s\n", fl.Name, formatValue(fl.Value, redact))
+	})
+
+	_, err := w.Write(buf.Bytes())
+	return errors.WithStack(err)
+}
+
+func formatValue(v flag.Value, redact func(string) string) string {
+	switch val := v.(type) {
+	case *StringList:
+		quoted := make([]string, 0, len(*val))
+		for _, s := range *val {
+			quoted = append(quoted, strconv.Quote(redact(s)))
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	case flag.Getter:
+		switch g := val.Get().(type) {
+		case bool, int, int64, uint, uint64, float64:
+			return fmt.Sprint(g)
+		}
+	}
+
+	return strconv.Quote(redact(v.String()))
+}
+
+// redactedPassword replace passwords in dumped values, same as url.URL.Redacted.
+const redactedPassword = "xxxxx"
+
+// redactURL mask the password of s when it is an url with one.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok {
+		return s
+	}
+
+	return u.Redacted()
+}
+
+// redactCredential mask the password of s in format name:password.
+func redactCredential(s string) string {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return s
+	}
+
+	return s[:i+1] + redactedPassword
+}
+
+func parseEntry(key, raw string, line int) (Entry, error) {
+	if raw == "" {
+		return Entry{}, errors.Errorf("missing value for %q", key)
+	}
+
+	entry := Entry{Key: key, Line: line}
+	if !strings.HasPrefix(raw, "[") {
+		v, rest, err := parseValue(raw)
+		if err != nil {
+			return Entry{}, err
+		}
+		if strings.TrimSpace(rest) != "" {
+			return Entry{}, errors.Errorf("unexpected %q after value", strings.TrimSpace(rest))
+		}
+		entry.Values = []string{v}
+		return entry, nil
+	}
+
+	entry.Array = true
+	rest := strings.TrimSpace(raw[1:])
+	for {
+		if strings.HasPrefix(rest, "]") {
+			rest = strings.TrimSpace(rest[1:])
+			break
+		}
+		v, r, err := parseValue(rest)
+		if err != nil {
+			return Entry{}, err
+		}
+		entry.Values = append(entry.Values, v)
+
+		rest = strings.TrimSpace(r)
+		switch {
+		case strings.HasPrefix(rest, ","):
+			rest = strings.TrimSpace(rest[1:])
+		case strings.HasPrefix(rest, "]"):
+		default:
+			return Entry{}, errors.Errorf("expected , or ] in array")
+		}
+	}
+	if rest != "" {
+		return Entry{}, errors.Errorf("unexpected %q after array", rest)
+	}
+
+	return entry, nil
+}
+
+// parseValue parse a scalar value at the start of s, return it and the rest of s.
+func parseValue(s string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		end := closingQuote(s)
+		if end < 0 {
+			return "", "", errors.New("unterminated string")
+		}
+		v, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return "", "", errors.Errorf("invalid string %s", s[:end+1])
+		}
+		return v, s[end+1:], nil
+	case strings.HasPrefix(s, "'"):
+		end := strings.Index(s[1:], "'")
+		if end < 0 {
+			return "", "", errors.New("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case strings.HasPrefix(s, "["):
+		return "", "", errors.New("nested arrays are not supported")
+	}
+
+	end := strings.IndexAny(s, ",]")
+	if end < 0 {
+		end = len(s)
+	}
+	token := strings.TrimSpace(s[:end])
+	switch {
+	case token == "true" || token == "false":
+	case isNumber(token):
+		token = strings.Replace(token, "_", "", -1)
+	default:
+		return "", "", errors.Errorf("invalid value %q, strings must be quoted", token)
+	}
+
+	return token, s[end:], nil
+}
+
+func parseKey(s string) (string, error) {
+	if strings.HasPrefix(s, `"`) {
+		k, err := strconv.Unquote(s)
+		if err != nil {
+			return "", errors.Errorf("invalid key %s", s)
+		}
+		s = k
+	}
+	if s == "" {
+		return "", errors.New("empty key")
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return "", errors.Errorf("invalid key %q", s)
+		}
+	}
+
+	return normalizeKey(s), nil
+}
+
+func normalizeKey(s string) string {
+	return strings.Replace(s, "_", "-", -1)
+}
+
+func isNumber(s string) bool {
+	s = strings.TrimLeft(s, "+-")
+	if s == "" {
+		return false
+	}
+	dot := false
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9', c == '_':
+		case c == '.' && !dot:
+			dot = true
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// closingQuote return the index of the quote closing the basic string at s[0].
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+
+	return -1
+}
+
+// stripComment remove the comment outside strings.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == 0 && c == '#':
+			return line[:i]
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		}
+	}
+
+	return line
+}
+
+// arrayClosed report whether brackets in s are balanced outside strings.
+func arrayClosed(s string) bool {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+
+	return depth <= 0
+}
+
+// StringList is a flag.Value for repeated flags, it is set from arrays in config file.
+type StringList []string
+
+// String implement flag.Value.
+func (l *StringList) String() string {
+	if l == nil {
+		return ""
+	}
+
+	return strings.Join(*l, ",")
+}
+
+// Set implement flag.Value, every call append a value.
+func (l *StringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// ApplyFile load the config file at path and apply it to fs, nothing is done when path is empty.
+func ApplyFile(fs *flag.FlagSet, path string) (*File, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, f.Apply(fs)
+}
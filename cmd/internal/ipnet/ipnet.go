@@ -0,0 +1,55 @@
+// Package ipnet implement CIDR lists of command options.
+package ipnet
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Nets is a list of CIDR networks.
+type Nets []*net.IPNet
+
+// Parse parse CIDR networks, a single ip is a network of itself.
+func Parse(list []string) (Nets, error) {
+	nets := make(Nets, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.Errorf("invalid ip or CIDR %q", s)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Errorf("invalid ip or CIDR %q", s)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// Contains report whether ip is in any of the networks.
+func (nets Nets) Contains(ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Allow report whether ip is allowed by nets as an allowlist, all allowed when nets is empty.
+func (nets Nets) Allow(ip net.IP) bool {
+	return len(nets) == 0 || nets.Contains(ip)
+}
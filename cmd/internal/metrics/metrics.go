@@ -0,0 +1,80 @@
+// Package metrics implement counters of commands served in Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var registry = struct {
+	sync.Mutex
+	counters map[string]*Counter
+	help     map[string]string
+}{counters: make(map[string]*Counter), help: make(map[string]string)}
+
+// Counter is a metric only increasing.
+type Counter struct {
+	v int64
+}
+
+// Inc add 1 to the counter.
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.v, 1)
+}
+
+// Value return the current value.
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+// NewCounter return the counter registered with name, the name may carry labels
+// like rejected_total{reason="ip"}, the same name return the same counter.
+func NewCounter(name, help string) *Counter {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if c, ok := registry.counters[name]; ok {
+		return c
+	}
+
+	c := &Counter{}
+	registry.counters[name] = c
+	registry.help[baseName(name)] = help
+
+	return c
+}
+
+// Handler serve all counters in Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registry.Lock()
+		names := make([]string, 0, len(registry.counters))
+		for name := range registry.counters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		var last string
+		for _, name := range names {
+			if base := baseName(name); base != last {
+				fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", base, registry.help[base], base)
+				last = base
+			}
+			fmt.Fprintf(w, "%s %d\n", name, registry.counters[name].Value())
+		}
+		registry.Unlock()
+	})
+}
+
+func baseName(name string) string {
+	if i := strings.Index(name, "{"); i >= 0 {
+		return name[:i]
+	}
+
+	return name
+}
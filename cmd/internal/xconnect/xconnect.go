@@ -0,0 +1,28 @@
+// Package xconnect enable websocket over HTTP/2 extended CONNECT(RFC 8441) in
+// golang.org/x/net/http2, which only advertises it when GODEBUG has http2xconnect=1
+// at its initialization. Import it before packages depending on http2, it sets
+// GODEBUG in init unless http2xconnect is set already.
+package xconnect
+
+import (
+	"os"
+	"strings"
+)
+
+const setting = "http2xconnect="
+
+func init() {
+	v := os.Getenv("GODEBUG")
+	if strings.Contains(v, setting) {
+		return
+	}
+	if v != "" {
+		v += ","
+	}
+	_ = os.Setenv("GODEBUG", v+setting+"1")
+}
+
+// Enabled report whether extended CONNECT is enabled by GODEBUG.
+func Enabled() bool {
+	return strings.Contains(os.Getenv("GODEBUG"), setting+"1")
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wuhuizuo/tcpb"
+	"github.com/wuhuizuo/tcpb/logging"
+)
+
+// audit output to stdout instead of a file.
+const auditStdout = "-"
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	Time         string   `json:"time"`
+	Event        string   `json:"event"` // start, end, or reject and fail for tunnels not started.
+	Session      uint64   `json:"session"`
+	Transport    string   `json:"transport"`
+	SourceIP     string   `json:"source_ip"`
+	ForwardedFor []string `json:"x_forwarded_for,omitempty"`
+	User         string   `json:"user,omitempty"`
+	Route        string   `json:"route,omitempty"`
+	Target       string   `json:"target"`
+	Resolved     string   `json:"resolved,omitempty"`
+	*auditTraffic
+	Reason string `json:"reason,omitempty"` // why the session ended or was not started.
+
+	// PrevHash and Hash chain the records when enabled, Hash should be the last field.
+	PrevHash string `json:"prev_hash,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// auditTraffic is the summary of an ended session.
+type auditTraffic struct {
+	BytesUp     int64   `json:"bytes_up"`
+	BytesDown   int64   `json:"bytes_down"`
+	Duration    float64 `json:"duration"`              // seconds.
+	Protocol    int     `json:"protocol,omitempty"`    // tcpb protocol version of websocket tunnels.
+	Compression float64 `json:"compression,omitempty"` // payload to websocket wire bytes ratio.
+}
+
+// auditSink write audit records as json lines, with hash chaining the hash of
+// every record covers the previous hash so modified or removed lines are detected.
+type auditSink struct {
+	mu       sync.Mutex
+	w        io.Writer
+	chain    bool
+	prevHash string
+}
+
+// newAuditSink return a sink writing to stdout or a file rotated by size in
+// MB with backups kept, the hash chain continues from the last record in file.
+func newAuditSink(path string, maxSize, maxBackups uint, chain bool) (*auditSink, error) {
+	if path == auditStdout {
+		return &auditSink{w: os.Stdout, chain: chain}, nil
+	}
+
+	var prevHash string
+	if chain {
+		h, err := lastAuditHash(path)
+		if err != nil {
+			return nil, err
+		}
+		prevHash = h
+	}
+	w, err := newRotateFile(path, int64(maxSize)<<20, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditSink{w: w, chain: chain, prevHash: prevHash}, nil
+}
+
+// start record a session started, a nil sink does nothing.
+func (a *auditSink) start(sess *session, st tcpb.Stats) {
+	if a == nil {
+		return
+	}
+
+	a.write(sess.auditRecord("start", st))
+}
+
+// end record a session ended with traffic stats, a nil sink does nothing.
+func (a *auditSink) end(sess *session, st tcpb.Stats) {
+	if a == nil {
+		return
+	}
+
+	rec := sess.auditRecord("end", st)
+	rec.auditTraffic = &auditTraffic{
+		BytesUp:     st.Up,
+		BytesDown:   st.Down,
+		Duration:    st.Duration.Seconds(),
+		Protocol:    st.Version,
+		Compression: compressionRatio(st),
+	}
+	rec.Reason = st.Reason
+	a.write(rec)
+}
+
+// reject record a tunnel request refused before dialing the target, a nil sink does nothing.
+func (a *auditSink) reject(sess *session, reason error) {
+	if a == nil {
+		return
+	}
+
+	rec := sess.auditRecord("reject", tcpb.Stats{})
+	rec.Reason = reason.Error()
+	a.write(rec)
+}
+
+// fail record a tunnel which target could not be connected, a nil sink does nothing.
+func (a *auditSink) fail(sess *session, reason error) {
+	if a == nil {
+		return
+	}
+
+	rec := sess.auditRecord("fail", tcpb.Stats{})
+	rec.Reason = reason.Error()
+	a.write(rec)
+}
+
+// compressionRatio return the compression ratio of st rounded to 2 decimals, 0 when not compressed.
+func compressionRatio(st tcpb.Stats) float64 {
+	return math.Round(st.Compression*100) / 100
+}
+
+func (a *auditSink) write(rec *auditRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.chain {
+		rec.PrevHash = a.prevHash
+	}
+	line, err := json.Marshal(rec)
+	if err == nil && a.chain {
+		rec.Hash = auditHash(line)
+		line, err = json.Marshal(rec)
+	}
+	if err == nil {
+		_, err = a.w.Write(append(line, '\n'))
+	}
+	if err != nil {
+		logging.Default().Log(logging.LevelError, "write audit record failed", "session", rec.Session, "event", rec.Event, "err", err)
+		return
+	}
+
+	if a.chain {
+		a.prevHash = rec.Hash
+	}
+}
+
+// auditRecord return the audit record of the session event.
+func (s *session) auditRecord(event string, st tcpb.Stats) *auditRecord {
+	return &auditRecord{
+		Time:         time.Now().UTC().Format(time.RFC3339Nano),
+		Event:        event,
+		Session:      s.id,
+		Transport:    s.transport,
+		SourceIP:     s.sourceIP,
+		ForwardedFor: s.forwardedFor,
+		User:         s.user,
+		Route:        s.route,
+		Target:       s.target,
+		Resolved:     st.Resolved,
+	}
+}
+
+// runAuditVerify verify the audit file with its backups, - for stdin, and return the
+// exit code. start is the hash the first record continues, empty for the chain start.
+func runAuditVerify(path, start string) int {
+	var r io.Reader = os.Stdin
+	if path != auditStdout {
+		var readers []io.Reader
+		for _, p := range auditFiles(path) {
+			f, err := os.Open(p)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+			defer f.Close()
+			readers = append(readers, f)
+		}
+		r = io.MultiReader(readers...)
+	}
+
+	n, err := verifyAudit(r, start)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit verify failed after %d records: %s\n", n, err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stdout, "%d records verified\n", n)
+	return 0
+}
+
+// auditChain is the hash chain fields of a record.
+type auditChain struct {
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// auditHash return the hex sha256 of a record marshaled without hash.
+func auditHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditFiles return the audit file at path and its rotated backups, from the oldest.
+func auditFiles(path string) []string {
+	files := []string{path}
+	for i := 1; ; i++ {
+		backup := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(backup); err != nil {
+			return files
+		}
+		files = append([]string{backup}, files...)
+	}
+}
+
+// verifyAudit check the hash chain of audit records read from r, the first record
+// should continue prevHash. It returns the number of records verified or the error
+// at the first broken line.
+func verifyAudit(r io.Reader, prevHash string) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var n int
+	for scanner.Scan() {
+		n++
+		line := scanner.Bytes()
+
+		var rec auditChain
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return n - 1, errors.Wrapf(err, "line %d", n)
+		}
+		if rec.Hash == "" {
+			return n - 1, errors.Errorf("line %d: no hash", n)
+		}
+		if rec.PrevHash != prevHash {
+			return n - 1, errors.Errorf("line %d: previous hash mismatch, lines are removed or reordered", n)
+		}
+
+		hashField := []byte(fmt.Sprintf(`,"hash":%q}`, rec.Hash))
+		if !bytes.HasSuffix(line, hashField) {
+			return n - 1, errors.Errorf("line %d: hash is not the last field", n)
+		}
+		unhashed := append(line[:len(line)-len(hashField):len(line)-len(hashField)], '}')
+		if auditHash(unhashed) != rec.Hash {
+			return n - 1, errors.Errorf("line %d: hash mismatch, the record is modified", n)
+		}
+		prevHash = rec.Hash
+	}
+
+	return n, errors.WithStack(scanner.Err())
+}
+
+// lastAuditHash return the hash of the last record in the audit file, or in the
+// newest backup when the file is empty after rotated, empty when none exist. It
+// fails when the last record is broken, so the chain is not restarted silently.
+func lastAuditHash(path string) (string, error) {
+	for _, p := range []string{path, path + ".1"} {
+		data, err := ioutil.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
+			continue
+		}
+
+		last := data[bytes.LastIndexByte(data, '\n')+1:]
+		var rec auditChain
+		if err := json.Unmarshal(last, &rec); err != nil {
+			return "", errors.Wrapf(err, "invalid last audit record in %s, repair or move the file", p)
+		}
+		return rec.Hash, nil
+	}
+
+	return "", nil
+}
+
+// forwardedForChain return the X-Forwarded-For chain of r.
+func forwardedForChain(r *http.Request) []string {
+	var chain []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, ip := range strings.Split(v, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				chain = append(chain, ip)
+			}
+		}
+	}
+
+	return chain
+}
+
+// rotateFile is a file rotated when its size exceed the max size, backups are
+// named path.1(the newest) to path.N.
+type rotateFile struct {
+	path       string
+	maxSize    int64
+	maxBackups uint
+
+	f    *os.File
+	size int64
+}
+
+func newRotateFile(path string, maxSize int64, maxBackups uint) (*rotateFile, error) {
+	w := &rotateFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *rotateFile) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+
+	w.f, w.size = f, info.Size()
+	return nil
+}
+
+// Write implement io.Writer, the file is rotated before writing when it would exceed the max size.
+func (w *rotateFile) Write(b []byte) (int, error) {
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(b)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.f.Write(b)
+	w.size += int64(n)
+
+	return n, errors.WithStack(err)
+}
+
+func (w *rotateFile) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if w.maxBackups == 0 {
+		if err := os.Remove(w.path); err != nil {
+			return errors.WithStack(err)
+		}
+		return w.open()
+	}
+
+	for i := w.maxBackups - 1; i > 0; i-- {
+		older := fmt.Sprintf("%s.%d", w.path, i)
+		if _, err := os.Stat(older); err == nil {
+			if err := os.Rename(older, fmt.Sprintf("%s.%d", w.path, i+1)); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return w.open()
+}
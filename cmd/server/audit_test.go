@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wuhuizuo/tcpb"
+)
+
+func TestAuditRecords(t *testing.T) {
+	sess := &session{id: 7, transport: "websocket", user: "alice", target: "db:5432", sourceIP: "10.1.2.3"}
+
+	tests := []struct {
+		name  string
+		write func(a *auditSink)
+		want  map[string]interface{}
+	}{
+		{
+			name:  "start",
+			write: func(a *auditSink) { a.start(sess, tcpb.Stats{Target: "db:5432", Resolved: "10.0.0.5:5432"}) },
+			want: map[string]interface{}{
+				"event": "start", "session": 7.0, "transport": "websocket", "source_ip": "10.1.2.3",
+				"user": "alice", "target": "db:5432", "resolved": "10.0.0.5:5432",
+			},
+		},
+		{
+			name: "end",
+			write: func(a *auditSink) {
+				a.end(sess, tcpb.Stats{Target: "db:5432", Up: 3, Down: 5, Duration: 2 * time.Second, Reason: "eof"})
+			},
+			want: map[string]interface{}{
+				"event": "end", "session": 7.0, "transport": "websocket", "source_ip": "10.1.2.3",
+				"user": "alice", "target": "db:5432", "bytes_up": 3.0, "bytes_down": 5.0, "duration": 2.0, "reason": "eof",
+			},
+		},
+		{
+			name:  "reject",
+			write: func(a *auditSink) { a.reject(sess, errSourceNotAllowed) },
+			want: map[string]interface{}{
+				"event": "reject", "session": 7.0, "transport": "websocket", "source_ip": "10.1.2.3",
+				"user": "alice", "target": "db:5432", "reason": "source ip not allowed",
+			},
+		},
+		{
+			name:  "fail",
+			write: func(a *auditSink) { a.fail(sess, errors.New("connection refused")) },
+			want: map[string]interface{}{
+				"event": "fail", "session": 7.0, "transport": "websocket", "source_ip": "10.1.2.3",
+				"user": "alice", "target": "db:5432", "reason": "connection refused",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			a := &auditSink{w: &buf, chain: true}
+			tt.write(a)
+
+			if n, err := verifyAudit(bytes.NewReader(buf.Bytes()), ""); n != 1 || err != nil {
+				t.Fatalf("verifyAudit() = %d, %v", n, err)
+			}
+
+			var got map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			for _, k := range []string{"time", "hash"} {
+				if got[k] == "" {
+					t.Errorf("%s is empty", k)
+				}
+				delete(got, k)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("record = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// a nil sink does nothing.
+	var a *auditSink
+	a.reject(sess, errSourceNotAllowed)
+	a.fail(sess, errSourceNotAllowed)
+}
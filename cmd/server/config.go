@@ -0,0 +1,363 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/wuhuizuo/tcpb"
+	"github.com/wuhuizuo/tcpb/cmd/internal/cfgfile"
+	"github.com/wuhuizuo/tcpb/cmd/internal/ipnet"
+	"github.com/wuhuizuo/tcpb/logging"
+	ws "github.com/wuhuizuo/tcpb/proxy/websocket"
+	"github.com/wuhuizuo/tcpb/resolve"
+	"github.com/wuhuizuo/tcpb/throttle"
+)
+
+type serverCfg struct {
+	host     string
+	port     uint
+	certFile string
+	keyFile  string
+
+	udpIdleTimeout uint
+	idleTimeout    uint
+
+	compression        bool
+	compressionLevel   int
+	compressionMinSize uint
+
+	acceptProxyProtocol bool
+	targetProxyProtocol uint
+	targetProxySource   string
+
+	users          cfgfile.StringList
+	allowTargets   cfgfile.StringList
+	trustedProxies cfgfile.StringList
+	trustedHeader  string
+	allowSources   cfgfile.StringList
+	routes         cfgfile.StringList
+
+	dialTimeout   uint
+	dialKeepAlive uint
+	dialSourceIP  string
+	egressProxy   string
+	vias          cfgfile.StringList
+	viaInsecure   bool
+
+	resolveHosts  cfgfile.StringList
+	dnsServer     string
+	dohURL        string
+	ipFamily      string
+	happyEyeballs bool
+
+	backendMaxFails      uint
+	backendFailTimeout   uint
+	backendCheckInterval uint
+
+	configWatch     uint
+	reloadTerminate bool
+	drainTimeout    uint
+
+	readyTargets  cfgfile.StringList
+	readyInterval uint
+
+	maxSessions          uint
+	maxSessionsPerUser   uint
+	maxSessionsPerIP     uint
+	maxSessionsPerTarget uint
+	rate                 float64
+	burst                uint
+
+	maxSessionDuration uint
+	maxSessionBytes    int64
+	sessionQuotas      cfgfile.StringList
+
+	bandwidthSessionUp   int64
+	bandwidthSessionDown int64
+	bandwidthUserUp      int64
+	bandwidthUserDown    int64
+	adminAddr            string
+
+	auditFile       string
+	auditMaxSize    uint
+	auditMaxBackups uint
+	auditHashChain  bool
+
+	logLevel  string
+	logFormat string
+}
+
+// cmdOptions are command line only options, they can not be set in config file.
+type cmdOptions struct {
+	configFile       string
+	printConfig      bool
+	showVersion      bool
+	auditVerify      string
+	auditVerifyStart string
+}
+
+// bindFlags define flags of config in fs, flag names are also the keys of config file.
+func bindFlags(fs *flag.FlagSet, cfg *serverCfg) {
+	fs.StringVar(&cfg.host, "host", "", "The ip to bind on, default all")
+	fs.UintVar(&cfg.port, "port", 8080, "The port to listen on")
+	fs.StringVar(&cfg.certFile, "tlscert", "", "TLS cert file path")
+	fs.StringVar(&cfg.keyFile, "tlskey", "", "TLS key file path")
+	fs.UintVar(&cfg.udpIdleTimeout, "udp-timeout", 60, "The idle timeout(second) for udp sessions")
+	fs.UintVar(&cfg.idleTimeout, "idle-timeout", 0, "The idle timeout(second) for tcp sessions without payload in either direction, heartbeats not counted, 0 for never")
+	fs.BoolVar(&cfg.compression, "compression", false, "accept websocket permessage-deflate compression offered by clients")
+	fs.IntVar(&cfg.compressionLevel, "compression-level", ws.DefaultCompressionLevel, "The flate level of websocket compression from -2(huffman only) to 9(best compression)")
+	fs.UintVar(&cfg.compressionMinSize, "compression-min-size", 0, "The min message size(byte) to compress, smaller messages are sent uncompressed")
+	fs.BoolVar(&cfg.acceptProxyProtocol, "accept-proxy-protocol", false, "require a PROXY protocol v1/v2 header on accepted connections when behind a load balancer, it can not be reloaded")
+	fs.UintVar(&cfg.targetProxyProtocol, "target-proxy-protocol", 0, "The PROXY protocol version(1 or 2) of the header carrying the client address sent to stream targets, 0 for none")
+	fs.StringVar(&cfg.targetProxySource, "target-proxy-source", proxySourceRemote, "The client address in PROXY headers sent to targets: remote for the request remote address, x-forwarded-for for the client ip forwarded by trusted proxies")
+	fs.Var(&cfg.users, "user", "The basic auth credential in format name:password, repeat for more users, no auth when not set")
+	fs.Var(&cfg.allowTargets, "allow-target", "The allowed target pattern like 10.0.0.*:22 or unix:/run/*.sock, repeat for more patterns, all tcp and udp targets allowed when not set, unix socket targets only allowed by unix: patterns")
+	fs.Var(&cfg.trustedProxies, "trusted-proxy", "The CIDR or ip of trusted reverse proxies, the client ip of their requests is taken from the header set by -trusted-proxy-header, repeat for more")
+	fs.StringVar(&cfg.trustedHeader, "trusted-proxy-header", realIPForwardedFor, "The header trusted proxies write the client ip to: forwarded|x-forwarded-for|x-real-ip, other headers are ignored")
+	fs.Var(&cfg.allowSources, "allow-source", "The CIDR or ip of clients allowed to open tunnels, checked with the client ip forwarded by trusted proxies, repeat for more, all allowed when not set")
+	fs.Var(&cfg.routes, "route", "The named target in format name=name,target=target[,target=target...][,balance=roundrobin|random|leastconn|hash][,user=name...][,source=CIDR...], tunnel paths are route names instead of targets when set, several stream targets are balanced with failover, hash is on the user or client ip, users and sources restrict the access, repeat for more routes")
+	fs.UintVar(&cfg.dialTimeout, "dial-timeout", 10, "The timeout(second) for dialing stream targets, 0 for the system default")
+	fs.UintVar(&cfg.dialKeepAlive, "dial-keepalive", 30, "The tcp keepalive period(second) of target connections, 0 to disable")
+	fs.StringVar(&cfg.dialSourceIP, "dial-source-ip", "", "The local ip to dial targets from, default chosen by the system")
+	fs.StringVar(&cfg.egressProxy, "egress-proxy", "", "The proxy url to reach stream targets through: socks5://[user:password@]host:port, socks5h to resolve targets by the proxy, direct when empty")
+	fs.Var(&cfg.resolveHosts, "resolve", "The static address of a target host in format host=ip, repeat for more hosts or addresses")
+	fs.StringVar(&cfg.dnsServer, "dns-server", "", "The DNS server host[:port] to resolve targets, default the system resolver")
+	fs.StringVar(&cfg.dohURL, "doh-url", "", "The DNS-over-HTTPS url to resolve targets like https://1.1.1.1/dns-query, queries go through the egress proxy, it has priority over dns-server")
+	fs.StringVar(&cfg.ipFamily, "ip-family", resolve.FamilyAny, "The ip family to dial targets: any|ip4|ip6")
+	fs.BoolVar(&cfg.happyEyeballs, "happy-eyeballs", false, "race the addresses of targets alternating ipv6 and ipv4 instead of trying them one by one")
+	fs.Var(&cfg.vias, "via", "The next tcpb server url to relay stream targets onward through, repeat for more hops in order, the target is the tunnel path of the last hop, the client credential is carried to https and wss hops without auth in url")
+	fs.BoolVar(&cfg.viaInsecure, "via-insecure", false, "skip verifying TLS certificates of via hops, and carry the client credential to http and ws hops too")
+	fs.UintVar(&cfg.backendMaxFails, "backend-max-fails", 3, "The consecutive dial failures marking a route backend down, down backends are tried only when all others fail")
+	fs.UintVar(&cfg.backendFailTimeout, "backend-fail-timeout", 30, "The duration(second) a route backend stays down after failures")
+	fs.UintVar(&cfg.backendCheckInterval, "backend-check-interval", 0, "The interval(second) for probing route backends by tcp dial, 0 for passive checks only, it can not be reloaded")
+	fs.UintVar(&cfg.configWatch, "config-watch", 0, "The interval(second) for checking config file changes to reload, 0 to reload only on SIGHUP")
+	fs.BoolVar(&cfg.reloadTerminate, "reload-terminate", false, "terminate existing sessions which are no longer allowed after reload")
+	fs.UintVar(&cfg.drainTimeout, "drain-timeout", 30, "The max duration(second) waiting live sessions to finish when shutting down, then they are closed by force")
+	fs.Var(&cfg.readyTargets, "ready-target", "The target required for readiness, format as tunnel target: host:port or unix:/path, repeat for more targets")
+	fs.UintVar(&cfg.readyInterval, "ready-interval", 10, "The interval(second) for probing ready targets")
+	fs.UintVar(&cfg.maxSessions, "max-sessions", 0, "The max concurrent sessions, 0 for unlimited")
+	fs.UintVar(&cfg.maxSessionsPerUser, "max-sessions-per-user", 0, "The max concurrent sessions of every authenticated user, 0 for unlimited")
+	fs.UintVar(&cfg.maxSessionsPerIP, "max-sessions-per-ip", 0, "The max concurrent sessions from every source ip, 0 for unlimited")
+	fs.UintVar(&cfg.maxSessionsPerTarget, "max-sessions-per-target", 0, "The max concurrent sessions to every target, 0 for unlimited")
+	fs.Float64Var(&cfg.rate, "rate", 0, "The max new tunnels per second from every source ip, 0 for unlimited")
+	fs.UintVar(&cfg.burst, "burst", 0, "The max new tunnels in a burst from every source ip, default the rate rounded up")
+	fs.UintVar(&cfg.maxSessionDuration, "max-session-duration", 0, "The max duration(second) of every session, clients should reconnect and authenticate again, 0 for unlimited")
+	fs.Int64Var(&cfg.maxSessionBytes, "max-session-bytes", 0, "The max payload bytes in both directions of every session, 0 for unlimited")
+	fs.Var(&cfg.sessionQuotas, "session-quota", "The max duration and bytes for a user or targets in format (user=name|target=pattern)[,duration=seconds][,bytes=n], repeat for more, the strictest of matched ones applies")
+	fs.Int64Var(&cfg.bandwidthSessionUp, "bandwidth-session-up", 0, "The max bytes per second from client to target of every session, 0 for unlimited")
+	fs.Int64Var(&cfg.bandwidthSessionDown, "bandwidth-session-down", 0, "The max bytes per second from target to client of every session, 0 for unlimited")
+	fs.Int64Var(&cfg.bandwidthUserUp, "bandwidth-user-up", 0, "The max bytes per second from client to target of all sessions of an authenticated user, 0 for unlimited")
+	fs.Int64Var(&cfg.bandwidthUserDown, "bandwidth-user-down", 0, "The max bytes per second from target to client of all sessions of an authenticated user, 0 for unlimited")
+	fs.StringVar(&cfg.adminAddr, "admin-addr", "", "The address for admin http api like 127.0.0.1:9090, disabled when empty, it can not be reloaded")
+	fs.StringVar(&cfg.auditFile, "audit-file", "", "The audit log file of session start and end records in json lines, - for stdout with logs to stderr, disabled when empty, it can not be reloaded")
+	fs.UintVar(&cfg.auditMaxSize, "audit-max-size", 100, "The max size(MB) of the audit file before rotated, 0 for never")
+	fs.UintVar(&cfg.auditMaxBackups, "audit-max-backups", 5, "The number of rotated audit files kept")
+	fs.BoolVar(&cfg.auditHashChain, "audit-hash-chain", false, "chain audit records by sha256 hashes to detect tampering, verify with -audit-verify")
+	fs.StringVar(&cfg.logLevel, "log-level", "info", "The log level: debug|info|warn|error")
+	fs.StringVar(&cfg.logFormat, "log-format", "text", "The log format: text|json")
+}
+
+// loadConfig parse args and the config file it points to into a new config.
+func loadConfig(args []string, errorHandling flag.ErrorHandling) (*serverCfg, *cmdOptions, error) {
+	var (
+		cfg  serverCfg
+		opts cmdOptions
+	)
+
+	fs := flag.NewFlagSet(os.Args[0], errorHandling)
+	bindFlags(fs, &cfg)
+	fs.StringVar(&opts.configFile, "config", "", "The config file path, TOML format with flag names as keys, flags on command line override file values")
+	fs.BoolVar(&opts.printConfig, "print-config", false, "prints the effective configuration with passwords masked and exit")
+	fs.BoolVar(&opts.showVersion, "version", false, "prints current version")
+	fs.StringVar(&opts.auditVerify, "audit-verify", "", "verify the hash chain of the audit file with its rotated backups from the oldest and exit, - for stdin to verify concatenated files")
+	fs.StringVar(&opts.auditVerifyStart, "audit-verify-start", "", "The hash of the record before the first verified one, required when older records are removed, empty for the start of the chain")
+	fs.Usage = func() { usage(fs) }
+	if errorHandling != flag.ExitOnError {
+		fs.SetOutput(ioutil.Discard)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if opts.showVersion || opts.auditVerify != "" {
+		return &cfg, &opts, nil
+	}
+
+	file, err := cfgfile.ApplyFile(fs, opts.configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cfg.validate(file); err != nil {
+		return nil, nil, err
+	}
+
+	if opts.printConfig {
+		if err := cfgfile.Dump(os.Stdout, fs, []string{"user"}, "config", "print-config", "version", "audit-verify", "audit-verify-start"); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return &cfg, &opts, nil
+}
+
+// bandwidthRates return the bandwidth of sessions, shared rates are aggregated by user.
+func (c *serverCfg) bandwidthRates() throttle.Rates {
+	return throttle.Rates{
+		SessionUp:   c.bandwidthSessionUp,
+		SessionDown: c.bandwidthSessionDown,
+		SharedUp:    c.bandwidthUserUp,
+		SharedDown:  c.bandwidthUserDown,
+	}
+}
+
+// wsCompression return the compression of websocket tunnels.
+func (c *serverCfg) wsCompression() ws.Compression {
+	return ws.Compression{Enabled: c.compression, Level: c.compressionLevel, MinSize: int(c.compressionMinSize)}
+}
+
+// resolveConfig return the resolving of targets.
+func (c *serverCfg) resolveConfig() resolve.Config {
+	return resolve.Config{
+		Hosts:         c.resolveHosts,
+		DNSServer:     c.dnsServer,
+		DoHURL:        c.dohURL,
+		Family:        c.ipFamily,
+		HappyEyeballs: c.happyEyeballs,
+	}
+}
+
+// validate check the config, errors are located in config file when the option set there.
+func (c *serverCfg) validate(file *cfgfile.File) error {
+	if c.port > 65535 {
+		return file.Errorf("port", "port out of range: %d", c.port)
+	}
+
+	if (c.certFile == "") != (c.keyFile == "") {
+		if c.certFile == "" {
+			return file.Errorf("tlskey", "tlscert is required with tlskey")
+		}
+		return file.Errorf("tlscert", "tlskey is required with tlscert")
+	}
+	for name, path := range map[string]string{"tlscert": c.certFile, "tlskey": c.keyFile} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return file.Errorf(name, "%s", err)
+		}
+	}
+
+	if err := c.wsCompression().Validate(); err != nil {
+		return file.Errorf("compression-level", "%s", err)
+	}
+
+	if c.targetProxyProtocol > 2 {
+		return file.Errorf("target-proxy-protocol", "unsupported proxy protocol version %d", c.targetProxyProtocol)
+	}
+	switch c.targetProxySource {
+	case proxySourceRemote, proxySourceForwarded:
+	default:
+		return file.Errorf("target-proxy-source", "unknown proxy source %q", c.targetProxySource)
+	}
+
+	for _, u := range c.users {
+		if i := strings.Index(u, ":"); i <= 0 {
+			return file.Errorf("user", "invalid credential %q, format: name:password", u)
+		}
+	}
+	if _, err := ipnet.Parse(c.trustedProxies); err != nil {
+		return file.Errorf("trusted-proxy", "%s", err)
+	}
+	switch c.trustedHeader {
+	case realIPForwarded, realIPForwardedFor, realIPRealIP:
+	default:
+		return file.Errorf("trusted-proxy-header", "unknown header %q", c.trustedHeader)
+	}
+	if _, err := ipnet.Parse(c.allowSources); err != nil {
+		return file.Errorf("allow-source", "%s", err)
+	}
+	names := make(map[string]bool)
+	for _, s := range c.routes {
+		rt, err := parseRoute(s)
+		if err != nil {
+			return file.Errorf("route", "%s", err)
+		}
+		if names[rt.name] {
+			return file.Errorf("route", "duplicate route name %q", rt.name)
+		}
+		names[rt.name] = true
+	}
+	if c.dialSourceIP != "" && net.ParseIP(c.dialSourceIP) == nil {
+		return file.Errorf("dial-source-ip", "invalid ip %q", c.dialSourceIP)
+	}
+	if _, err := resolve.ParseHosts(c.resolveHosts); err != nil {
+		return file.Errorf("resolve", "%s", err)
+	}
+	if _, err := resolve.ParseFamily(c.ipFamily); err != nil {
+		return file.Errorf("ip-family", "%s", err)
+	}
+	rc := c.resolveConfig()
+	if _, err := rc.NewDialer(nil, nil); err != nil {
+		return file.Errorf("doh-url", "%s", err)
+	}
+	if _, err := newDialer(c); err != nil {
+		return file.Errorf("egress-proxy", "%s", err)
+	}
+	if _, err := parseVias(c.vias); err != nil {
+		return file.Errorf("via", "%s", err)
+	}
+	if c.backendMaxFails == 0 {
+		return file.Errorf("backend-max-fails", "max fails should be greater than 0")
+	}
+	for _, p := range c.allowTargets {
+		if err := validPattern(p); err != nil {
+			return file.Errorf("allow-target", "%s", err)
+		}
+	}
+
+	for _, t := range c.readyTargets {
+		if network, _ := tcpb.ParseTarget(t); network == "udp" {
+			return file.Errorf("ready-target", "udp target %q can not be probed", t)
+		}
+	}
+	if c.readyInterval == 0 {
+		return file.Errorf("ready-interval", "interval should be greater than 0")
+	}
+
+	if c.rate < 0 {
+		return file.Errorf("rate", "rate should not be negative")
+	}
+	if c.maxSessionBytes < 0 {
+		return file.Errorf("max-session-bytes", "bytes should not be negative")
+	}
+	for _, q := range c.sessionQuotas {
+		if _, err := parseQuota(q); err != nil {
+			return file.Errorf("session-quota", "%s", err)
+		}
+	}
+
+	for name, v := range map[string]int64{
+		"bandwidth-session-up":   c.bandwidthSessionUp,
+		"bandwidth-session-down": c.bandwidthSessionDown,
+		"bandwidth-user-up":      c.bandwidthUserUp,
+		"bandwidth-user-down":    c.bandwidthUserDown,
+	} {
+		if v < 0 {
+			return file.Errorf(name, "bandwidth should not be negative")
+		}
+	}
+
+	if _, err := logging.ParseLevel(c.logLevel); err != nil {
+		return file.Errorf("log-level", "%s", err)
+	}
+	switch logging.Format(c.logFormat) {
+	case logging.FormatText, logging.FormatJSON:
+	default:
+		return file.Errorf("log-format", "unknown log format %q", c.logFormat)
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	netproxy "golang.org/x/net/proxy"
+)
+
+// newDialer return the dialer of targets with the timeout, keepalive, source ip and
+// resolving of cfg, tcp targets are reached through the egress socks5 proxy when set.
+func newDialer(cfg *serverCfg) (netproxy.ContextDialer, error) {
+	d, err := newEgressDialer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// names are passed to socks5h proxies unless resolving is configured.
+	rc := cfg.resolveConfig()
+	if rc.Empty() {
+		return d, nil
+	}
+
+	return rc.NewDialer(d, d)
+}
+
+// newEgressDialer return the dialer of resolved targets.
+func newEgressDialer(cfg *serverCfg) (netproxy.ContextDialer, error) {
+	d := &sourceDialer{Dialer: net.Dialer{
+		Timeout:   time.Duration(cfg.dialTimeout) * time.Second,
+		KeepAlive: time.Duration(cfg.dialKeepAlive) * time.Second,
+	}}
+	if cfg.dialKeepAlive == 0 {
+		d.KeepAlive = -1
+	}
+	if cfg.dialSourceIP != "" {
+		d.sourceIP = net.ParseIP(cfg.dialSourceIP)
+		if d.sourceIP == nil {
+			return nil, errors.Errorf("invalid source ip %q", cfg.dialSourceIP)
+		}
+	}
+
+	if cfg.egressProxy == "" {
+		return d, nil
+	}
+
+	u, err := url.Parse(cfg.egressProxy)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, errors.Errorf("unsupported egress proxy scheme %q, only socks5 and socks5h", u.Scheme)
+	}
+	p, err := netproxy.FromURL(u, d)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cd, ok := p.(netproxy.ContextDialer)
+	if !ok {
+		return nil, errors.Errorf("egress proxy %q does not support dialing with context", u.Redacted())
+	}
+
+	return &egressDialer{proxy: cd, direct: d}, nil
+}
+
+// egressDialer dial tcp through the proxy with the handshake bound by the dial
+// timeout, unix sockets and udp are dialed directly.
+type egressDialer struct {
+	proxy  netproxy.ContextDialer
+	direct *sourceDialer
+}
+
+func (d *egressDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return d.direct.DialContext(ctx, network, address)
+	}
+
+	if d.direct.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.direct.Timeout)
+		defer cancel()
+	}
+
+	c, err := d.proxy.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return relayed(c, network, address), nil
+}
+
+// sourceDialer bind the local address of tcp and udp connections to the source ip
+// when set, unix sockets are dialed without it.
+type sourceDialer struct {
+	net.Dialer
+	sourceIP net.IP
+}
+
+func (d *sourceDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	nd := d.Dialer
+	if d.sourceIP != nil {
+		switch {
+		case strings.HasPrefix(network, "tcp"):
+			nd.LocalAddr = &net.TCPAddr{IP: d.sourceIP}
+		case strings.HasPrefix(network, "udp"):
+			nd.LocalAddr = &net.UDPAddr{IP: d.sourceIP}
+		}
+	}
+
+	return nd.DialContext(ctx, network, address)
+}
+
+func (d *sourceDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// relayedConn is a target connection through a proxy or relay server, which
+// RemoteAddr is the address of the proxy.
+type relayedConn struct {
+	net.Conn
+	target net.Addr // nil when dialed by name, the proxy resolves it.
+}
+
+// TargetAddr return the address of the target, see tcpb.Bridge.Dialer.
+func (c *relayedConn) TargetAddr() net.Addr {
+	return c.target
+}
+
+// relayed wrap c dialed through a proxy to address on network.
+func relayed(c net.Conn, network, address string) net.Conn {
+	rc := &relayedConn{Conn: c}
+	if network == "unix" {
+		rc.target = &net.UnixAddr{Name: address, Net: network}
+	} else if host, _, err := net.SplitHostPort(address); err == nil && net.ParseIP(host) != nil {
+		if addr, err := net.ResolveTCPAddr("tcp", address); err == nil {
+			rc.target = addr
+		}
+	}
+
+	return rc
+}
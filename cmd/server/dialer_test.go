@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRelayed(t *testing.T) {
+	tests := []struct {
+		network string
+		address string
+		want    string // empty for unknown.
+	}{
+		{network: "tcp", address: "10.0.0.5:5432", want: "10.0.0.5:5432"},
+		{network: "tcp", address: "[2001:db8::5]:443", want: "[2001:db8::5]:443"},
+		{network: "tcp", address: "db.internal:5432"},
+		{network: "unix", address: "/run/app.sock", want: "/run/app.sock"},
+	}
+
+	for _, tt := range tests {
+		c1, c2 := net.Pipe()
+		c := relayed(c1, tt.network, tt.address)
+
+		addr := c.(*relayedConn).TargetAddr()
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tt.want {
+			t.Errorf("relayed(%s, %s) target = %q, want %q", tt.network, tt.address, got, tt.want)
+		}
+		if c.RemoteAddr() != c1.RemoteAddr() {
+			t.Errorf("relayed(%s, %s) remote = %v, want the proxy", tt.network, tt.address, c.RemoteAddr())
+		}
+
+		c1.Close()
+		c2.Close()
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/wuhuizuo/tcpb"
+	"github.com/wuhuizuo/tcpb/logging"
+)
+
+// reserved paths, they are never taken as tunnel targets.
+const (
+	healthPath = "/healthz"
+	readyPath  = "/readyz"
+
+	probeTimeout = 3 * time.Second
+)
+
+// readiness hold the results of probing required targets.
+type readiness struct {
+	mu     sync.Mutex
+	probed bool
+	errs   map[string]error // target -> last probe error, nil for reachable.
+}
+
+// healthz report the process is alive and whether it is draining.
+func (s *server) healthz(w http.ResponseWriter, r *http.Request) {
+	status := "ok"
+	if s.isDraining() {
+		status = "draining"
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":   status,
+		"sessions": s.sessions.count(),
+	})
+}
+
+// readyz report whether the server should receive new tunnels, it fails
+// when draining or any required target is unreachable.
+func (s *server) readyz(w http.ResponseWriter, r *http.Request) {
+	ready := !s.isDraining()
+	targets := make(map[string]string)
+
+	s.ready.mu.Lock()
+	if len(s.runtime().cfg.readyTargets) > 0 && !s.ready.probed {
+		ready = false
+	}
+	for target, err := range s.ready.errs {
+		targets[target] = "ok"
+		if err != nil {
+			targets[target] = err.Error()
+			ready = false
+		}
+	}
+	s.ready.mu.Unlock()
+
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not ready", http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, code, map[string]interface{}{
+		"status":   status,
+		"draining": s.isDraining(),
+		"targets":  targets,
+	})
+}
+
+// probeLoop dial the required targets periodically, targets are taken from
+// runtime on every round so they can be reloaded.
+func (s *server) probeLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.probe(s.runtime().cfg.readyTargets)
+		<-ticker.C
+	}
+}
+
+func (s *server) probe(targets []string) {
+	errs := make(map[string]error, len(targets))
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+
+			c, err := s.dialProbe(target)
+			if err == nil {
+				c.Close()
+			} else {
+				logging.Default().Log(logging.LevelWarn, "ready target unreachable", "target", target, "err", err)
+			}
+
+			mu.Lock()
+			errs[target] = err
+			mu.Unlock()
+		}(target)
+	}
+	wg.Wait()
+
+	s.ready.mu.Lock()
+	s.ready.errs = errs
+	s.ready.probed = true
+	s.ready.mu.Unlock()
+}
+
+// checkBackendsLoop probe backends of balanced routes periodically, unreachable
+// ones are marked down until probed reachable, routes are taken from runtime on
+// every round so they can be reloaded.
+func (s *server) checkBackendsLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, route := range s.runtime().policy.routes {
+			if !route.balanced() {
+				continue
+			}
+			for addr, err := range s.backends.Group(route.balance, route.backends).Probe(s.dialProbe) {
+				if err != nil {
+					logging.Default().Log(logging.LevelWarn, "route backend unreachable", "route", route.name, "backend", addr, "err", err)
+				}
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// dialProbe dial the stream target in probe timeout like sessions do, through via
+// hops when set, without client credentials.
+func (s *server) dialProbe(target string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	network, address := tcpb.ParseTarget(target)
+	return s.runtime().targetDialer("", "").DialContext(ctx, network, address)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
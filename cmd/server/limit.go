@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// retry delay suggested when a concurrent sessions limit is reached.
+	sessionLimitRetryAfter = time.Second
+
+	// rate buckets are swept when there are more than this number of source addresses.
+	maxRateBuckets = 4096
+)
+
+// limitError is returned when a new tunnel exceeds a limit.
+type limitError struct {
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e *limitError) Error() string {
+	return e.reason
+}
+
+// limiter track concurrent sessions and the rate of new tunnels, limits
+// are taken from the config on every check so they can be reloaded.
+type limiter struct {
+	mu      sync.Mutex
+	total   uint
+	users   map[string]uint
+	ips     map[string]uint
+	targets map[string]uint
+	buckets map[string]*bucket // source ip -> new tunnels rate.
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		users:   make(map[string]uint),
+		ips:     make(map[string]uint),
+		targets: make(map[string]uint),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// acquire reserve a session slot, the returned release should be called when the session end.
+func (l *limiter) acquire(cfg *serverCfg, user, ip, target string) (func(), *limitError) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if cfg.rate > 0 {
+		if wait := l.takeToken(cfg, ip); wait > 0 {
+			return nil, &limitError{reason: "too many new tunnels", retryAfter: wait}
+		}
+	}
+
+	switch {
+	case exceed(l.total, cfg.maxSessions):
+		return nil, &limitError{reason: "too many sessions", retryAfter: sessionLimitRetryAfter}
+	case user != "" && exceed(l.users[user], cfg.maxSessionsPerUser):
+		return nil, &limitError{reason: fmt.Sprintf("too many sessions for user %s", user), retryAfter: sessionLimitRetryAfter}
+	case exceed(l.ips[ip], cfg.maxSessionsPerIP):
+		return nil, &limitError{reason: fmt.Sprintf("too many sessions from %s", ip), retryAfter: sessionLimitRetryAfter}
+	case exceed(l.targets[target], cfg.maxSessionsPerTarget):
+		return nil, &limitError{reason: fmt.Sprintf("too many sessions to %s", target), retryAfter: sessionLimitRetryAfter}
+	}
+
+	l.total++
+	if user != "" {
+		l.users[user]++
+	}
+	l.ips[ip]++
+	l.targets[target]++
+
+	var once sync.Once
+	return func() { once.Do(func() { l.release(user, ip, target) }) }, nil
+}
+
+func (l *limiter) release(user, ip, target string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if user != "" {
+		decrease(l.users, user)
+	}
+	decrease(l.ips, ip)
+	decrease(l.targets, target)
+}
+
+// takeToken take a token from the bucket of ip, it returns the duration to wait when no token left.
+func (l *limiter) takeToken(cfg *serverCfg, ip string) time.Duration {
+	now := time.Now()
+	burst := float64(cfg.burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(cfg.rate))
+	}
+
+	if len(l.buckets) > maxRateBuckets {
+		for k, b := range l.buckets {
+			if b.fill(now, cfg.rate, burst) >= burst {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[ip] = b
+	}
+
+	if b.fill(now, cfg.rate, burst) < 1 {
+		return time.Duration((1 - b.tokens) / cfg.rate * float64(time.Second))
+	}
+	b.tokens--
+
+	return 0
+}
+
+// bucket is a token bucket refilled at a rate per second.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) fill(now time.Time, rate, burst float64) float64 {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	return b.tokens
+}
+
+func exceed(n, max uint) bool {
+	return max > 0 && n >= max
+}
+
+func decrease(m map[string]uint, key string) {
+	if m[key] <= 1 {
+		delete(m, key)
+		return
+	}
+	m[key]--
+}
+
+// writeLimitError write 429 with Retry-After in seconds.
+func writeLimitError(w http.ResponseWriter, err *limitError) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(err.retryAfter.Seconds()))))
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
+
+// statusRecorder record the status code written to http response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(b)
+}
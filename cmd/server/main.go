@@ -1,15 +1,36 @@
 package main
 
 import (
+	// initialized before golang.org/x/net/http2 to enable extended CONNECT.
+	"github.com/wuhuizuo/tcpb/cmd/internal/xconnect"
+
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
 	"github.com/wuhuizuo/tcpb"
+	"github.com/wuhuizuo/tcpb/balance"
+	"github.com/wuhuizuo/tcpb/cmd/internal/admin"
+	"github.com/wuhuizuo/tcpb/cmd/internal/metrics"
+	"github.com/wuhuizuo/tcpb/logging"
+	"github.com/wuhuizuo/tcpb/proxy/poll"
+	ws "github.com/wuhuizuo/tcpb/proxy/websocket"
+	"github.com/wuhuizuo/tcpb/proxyproto"
+	"github.com/wuhuizuo/tcpb/throttle"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // release version info
@@ -18,94 +39,468 @@ var (
 	buildDate string
 )
 
-type (
-	httpHandlerFunc func(w http.ResponseWriter, r *http.Request)
-
-	serverCfg struct {
-		host     string
-		port     uint
-		certFile string
-		keyFile  string
-	}
+// errors of tunnel requests rejected before policies.
+var (
+	errDraining     = errors.New("server is shutting down")
+	errUDPTransport = errors.New("udp target only supported with websocket tunnel")
+	errUDPVia       = errors.New("udp target can not be relayed onward")
 )
 
+// server serve tunnel requests with the reloadable runtime.
+type server struct {
+	args     []string     // command line args, parsed again on reload.
+	rt       atomic.Value // *runtime
+	sessions *sessionRegistry
+	poll     *poll.Server // sessions of split upload/download tunnels.
+	upgrader *websocket.Upgrader
+	srv      *http.Server
+	draining int32 // set when shutting down, new tunnels are rejected.
+	ready    readiness
+	limits   *limiter
+
+	bandwidth *throttle.Policy // bandwidth of sessions, aggregated by user.
+	backends  *balance.Pool    // health of route backends, kept across reloads.
+	audit     *auditSink       // nil when disabled.
+}
+
 func main() {
-	var cfg serverCfg
+	cfg, opts, err := loadConfig(os.Args[1:], flag.ExitOnError)
+	if err == nil {
+		if opts.showVersion {
+			printVersion()
+			os.Exit(0)
+		}
+		if opts.auditVerify != "" {
+			os.Exit(runAuditVerify(opts.auditVerify, opts.auditVerifyStart))
+		}
+		if opts.printConfig {
+			os.Exit(0)
+		}
+		err = setupLogging(cfg.logLevel, cfg.logFormat, logOutput(cfg.auditFile))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	s, err := newServer(os.Args[1:], cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	go s.watchReload(opts.configFile, time.Duration(cfg.configWatch)*time.Second)
+	go s.probeLoop(time.Duration(cfg.readyInterval) * time.Second)
+	if cfg.backendCheckInterval > 0 {
+		go s.checkBackendsLoop(time.Duration(cfg.backendCheckInterval) * time.Second)
+	}
+
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.serve() }()
+
+	select {
+	case err := <-errCh:
+		logging.Default().Log(logging.LevelError, "serve failed", "err", err)
+		os.Exit(1)
+	case oscall := <-sig:
+		logging.Default().Log(logging.LevelWarn, "system call", "signal", oscall)
+	}
+
+	// a second signal stop draining at once.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.runtime().cfg.drainTimeout)*time.Second)
+	defer cancel()
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	s.shutdown(ctx)
+	logging.Default().Log(logging.LevelWarn, "exit normally")
+}
+
+func newServer(args []string, cfg *serverCfg) (*server, error) {
+	rt, err := newRuntime(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &server{
+		args:     args,
+		sessions: newSessionRegistry(),
+		poll:     &poll.Server{},
+		limits:   newLimiter(),
+		upgrader: &websocket.Upgrader{Subprotocols: ws.Protocols},
+		srv:      &http.Server{Addr: fmt.Sprintf("%s:%d", cfg.host, cfg.port)},
+
+		bandwidth: throttle.NewPolicy(cfg.bandwidthRates()),
+		backends:  balance.NewPool(cfg.backendMaxFails, time.Duration(cfg.backendFailTimeout)*time.Second),
+	}
+	s.rt.Store(rt)
+
+	if cfg.auditFile != "" {
+		if s.audit, err = newAuditSink(cfg.auditFile, cfg.auditMaxSize, cfg.auditMaxBackups, cfg.auditHashChain); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.adminAddr != "" {
+		api := admin.New()
+		api.Handle("/bandwidth", admin.BandwidthHandler(s.bandwidth))
+		api.Handle("/metrics", metrics.Handler())
+		if err := api.Start(cfg.adminAddr); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *server) runtime() *runtime {
+	return s.rt.Load().(*runtime)
+}
+
+// setupLogging set the default logger writing to w with level and format from command line.
+func setupLogging(level, format string, w io.Writer) error {
+	lvl, err := logging.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	logger, err := logging.New(w, logging.Format(format), lvl)
+	if err != nil {
+		return err
+	}
+	logging.SetDefault(logger)
+
+	return nil
+}
+
+// logOutput return the writer of logs, stderr when audit records are written to stdout.
+func logOutput(auditFile string) io.Writer {
+	if auditFile == auditStdout {
+		return os.Stderr
+	}
 
-	flag.StringVar(&cfg.host, "host", "", "The ip to bind on, default all")
-	flag.UintVar(&cfg.port, "port", 8080, "The port to listen on")
-	flag.StringVar(&cfg.certFile, "tlscert", "", "TLS cert file path")
-	flag.StringVar(&cfg.keyFile, "tlskey", "", "TLS key file path")
-	showVersion := flag.Bool("version", false, "prints current version")
-	flag.Usage = usage
+	return os.Stdout
+}
 
-	flag.Parse()
+// newBridge return a bridge for the session, release should be called when the session end.
+// The password of the request is only carried to via hops, sessions do not keep it.
+func (s *server) newBridge(sess *session, password string) (*tcpb.Bridge, func()) {
+	bw, release := s.bandwidth.Session(sess.user)
 
-	if showVersion != nil && *showVersion {
-		printVersion()
-		os.Exit(0)
+	rt := s.runtime()
+	maxDuration, maxBytes := rt.policy.sessionQuota(sess.user, sess.target)
+
+	var proxyHeader *proxyproto.Header
+	if rt.cfg.targetProxyProtocol > 0 {
+		proxyHeader = sess.proxyHeader(rt.cfg.targetProxyProtocol, rt.cfg.targetProxySource)
 	}
 
-	if err := serve(cfg); err != nil {
-		log.Fatalf("[ERROR] %s\n", err)
+	var balancer tcpb.Balancer
+	if sess.backends != nil {
+		balancer = sess.backends.Picker(sess.balanceKey())
 	}
+
+	return &tcpb.Bridge{
+		Dialer:            rt.targetDialer(sess.user, password),
+		Balancer:          balancer,
+		TargetProxyHeader: proxyHeader,
+		Compression:       rt.cfg.wsCompression(),
+		UDPIdleTimeout:    time.Duration(rt.cfg.udpIdleTimeout) * time.Second,
+		IdleTimeout:       time.Duration(rt.cfg.idleTimeout) * time.Second,
+		MaxDuration:       maxDuration,
+		MaxBytes:          maxBytes,
+		Bandwidth:         bw,
+		OnSessionStart: func(st tcpb.Stats) {
+			sess.connected = true
+			s.audit.start(sess, st)
+		},
+		OnSessionEnd: func(st tcpb.Stats) {
+			logging.Default().Log(logging.LevelInfo, "session ended", "id", sess.id, "user", sess.user, "route", sess.route, "target", st.Target, "backend", st.Resolved,
+				"up", st.Up, "down", st.Down, "duration", st.Duration.Round(time.Millisecond), "reason", st.Reason, "protocol", st.Version, "compression", compressionRatio(st))
+			s.audit.end(sess, st)
+		},
+	}, release
 }
 
-func serve(cfg serverCfg) error {
-	http.HandleFunc("/", relayHandler(nil))
-	serveAddr := fmt.Sprintf("%s:%d", cfg.host, cfg.port)
+func (s *server) serve() error {
+	cfg := s.runtime().cfg
+	http.HandleFunc("/", s.relay)
+	http.HandleFunc(healthPath, s.healthz)
+	http.HandleFunc(readyPath, s.readyz)
+	http.HandleFunc(routesPath, s.listRoutes)
+	srv := s.srv
+	h2Srv := &http2.Server{}
+
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	if cfg.acceptProxyProtocol {
+		l = proxyproto.NewListener(l)
+	}
 
 	if cfg.certFile == "" || cfg.keyFile == "" {
-		log.Printf("[INFO ] Listening on ws://%s\n", serveAddr)
-		return http.ListenAndServe(serveAddr, nil)
+		logging.Default().Log(logging.LevelInfo, "listening", "url", "ws://"+srv.Addr)
+		// accept h2c(HTTP/2 with prior knowledge) for http/2 stream tunnels.
+		srv.Handler = h2c.NewHandler(http.DefaultServeMux, h2Srv)
+		return srv.Serve(l)
 	}
 
-	log.Printf("[INFO ] Listening on wss://%s\n", serveAddr)
-	return http.ListenAndServeTLS(serveAddr, cfg.certFile, cfg.keyFile, nil)
+	// certificate is taken from runtime for every handshake, so it can be reloaded.
+	srv.TLSConfig = &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.runtime().cert, nil
+		},
+	}
+	if err := http2.ConfigureServer(srv, h2Srv); err != nil {
+		return err
+	}
+	if !xconnect.Enabled() {
+		logging.Default().Log(logging.LevelWarn, "websocket over HTTP/2 extended CONNECT is disabled by GODEBUG, clients fall back to HTTP/1.1", "GODEBUG", os.Getenv("GODEBUG"))
+	}
+
+	logging.Default().Log(logging.LevelInfo, "listening", "url", "wss://"+srv.Addr)
+	return srv.ServeTLS(l, "", "")
 }
 
-func relayHandler(upgrader *websocket.Upgrader) httpHandlerFunc {
-	if upgrader == nil {
-		upgrader = &websocket.Upgrader{}
+func (s *server) relay(w http.ResponseWriter, r *http.Request) {
+	reqPath := strings.TrimLeft(r.URL.Path, "/")
+	if reqPath == "" {
+		w.Header().Add("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("empty remote address"))
+		return
 	}
 
-	return func(w http.ResponseWriter, r *http.Request) {
-		tcpAddress := strings.TrimLeft(r.URL.Path, "/")
-		if tcpAddress == "" {
-			w.Header().Add("Content-Type", "text/html")
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("empty remote address"))
-			return
+	rt := s.runtime()
+	clientIP := realIP(r, rt.trusted, rt.cfg.trustedHeader)
+	user, password, _ := r.BasicAuth()
+	digest := passwordDigest(password)
+	sess := &session{
+		transport:    requestTransport(r),
+		user:         user,
+		digest:       digest,
+		target:       reqPath,
+		remote:       r.RemoteAddr,
+		started:      time.Now(),
+		sourceIP:     clientIP,
+		forwardedFor: forwardedForChain(r),
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		sess.local = addr
+	}
+
+	// only new tunnels are audited and limited, the following requests of poll sessions are not.
+	newTunnel := !poll.IsPollRequest(r) || poll.IsOpenRequest(r)
+	reject := func(err error) {
+		if newTunnel {
+			s.audit.reject(sess, err)
 		}
+	}
 
-		log.Println("[INFO ] receive tunnel request for tcp: ", tcpAddress)
-		wsCon, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			log.Printf("[ERROR] %v\n", err)
-			return
+	if s.isDraining() && newTunnel {
+		reject(errDraining)
+		w.Header().Set("Connection", "close")
+		http.Error(w, errDraining.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if !rt.sources.Allow(net.ParseIP(clientIP)) {
+		logging.Default().Log(logging.LevelWarn, "reject tunnel request", "path", reqPath, "client", clientIP, "reason", errSourceNotAllowed)
+		rejectedSource.Inc()
+		reject(errSourceNotAllowed)
+		http.Error(w, errSourceNotAllowed.Error(), http.StatusForbidden)
+		return
+	}
+
+	routeName, tcpAddress, err := rt.policy.authorize(user, digest, reqPath, net.ParseIP(clientIP))
+	if err != nil {
+		logging.Default().Log(logging.LevelWarn, "reject tunnel request", "path", reqPath, "client", clientIP, "user", user, "reason", err)
+		reject(err)
+		switch err {
+		case errUnauthorized:
+			rejectedUnauthorized.Inc()
+		case errRouteNotFound:
+			rejectedNotFound.Inc()
+		default:
+			rejectedForbidden.Inc()
 		}
-		defer func() {
-			log.Println("[INFO ] close websocket connection")
-			wsCon.Close()
-		}()
-
-		bridge := tcpb.Bridge{}
-		if err := bridge.WS2TCP(wsCon, tcpAddress); err != nil {
-			log.Printf("[ERROR] %v\n", err)
+		writePolicyError(w, err)
+		return
+	}
+
+	sess.route, sess.target = routeName, tcpAddress
+
+	network, address := tcpb.ParseTarget(tcpAddress)
+	if network == "udp" && !websocket.IsWebSocketUpgrade(r) && !ws.IsExtendedConnect(r) {
+		reject(errUDPTransport)
+		http.Error(w, errUDPTransport.Error(), http.StatusBadRequest)
+		return
+	}
+	if network == "udp" && len(rt.vias) > 0 {
+		reject(errUDPVia)
+		http.Error(w, errUDPVia.Error(), http.StatusBadRequest)
+		return
+	}
+
+	release := func() {}
+	if newTunnel {
+		var limitErr *limitError
+		release, limitErr = s.limits.acquire(rt.cfg, user, clientIP, tcpAddress)
+		if limitErr != nil {
+			logging.Default().Log(logging.LevelWarn, "reject tunnel request", "target", tcpAddress, "client", clientIP, "user", user, "reason", limitErr)
+			rejectedLimit.Inc()
+			reject(limitErr)
+			writeLimitError(w, limitErr)
+			return
 		}
 	}
+	if route := rt.policy.routes[routeName]; route != nil && route.balanced() {
+		sess.backends = s.backends.Group(route.balance, route.backends)
+	}
+
+	if poll.IsPollRequest(r) {
+		s.pollRelay(w, r, sess, release)
+		return
+	}
+	defer release()
+	if r.Method == http.MethodPost {
+		s.streamRelay(w, r, sess)
+		return
+	}
+
+	logger := logging.Default()
+	logger.Log(logging.LevelInfo, "receive tunnel request", "transport", "websocket", "target", tcpAddress, "client", clientIP)
+	wsCon, err := s.upgrade(w, r)
+	if err != nil {
+		logger.Log(logging.LevelError, "upgrade websocket failed", "client", clientIP, "err", err)
+		return
+	}
+	defer func() {
+		logger.Log(logging.LevelDebug, "close websocket connection", "client", clientIP)
+		wsCon.Close()
+	}()
+
+	sess.transport, sess.close = "websocket", wsCon.Close
+	sess.goAway = func() error {
+		msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+		return wsCon.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	}
+	s.sessions.add(sess)
+	defer s.sessions.remove(sess)
+
+	bridge, releaseBridge := s.newBridge(sess, password)
+	defer releaseBridge()
+	if network == "udp" {
+		err = bridge.WS2UDP(wsCon, address)
+	} else {
+		err = bridge.WS2TCP(wsCon, tcpAddress)
+	}
+	if err != nil {
+		s.tunnelFailed(sess, err)
+	}
 }
 
-func usage() {
+// requestTransport return the transport of a tunnel request.
+func requestTransport(r *http.Request) string {
+	switch {
+	case poll.IsPollRequest(r):
+		return "poll"
+	case r.Method == http.MethodPost:
+		return "h2stream"
+	default:
+		return "websocket"
+	}
+}
+
+// tunnelFailed log a failed tunnel, it is audited when the target is not connected,
+// otherwise the session end is.
+func (s *server) tunnelFailed(sess *session, err error) {
+	logging.Default().Log(logging.LevelError, "tunnel failed", "target", sess.target, "err", err)
+	if !sess.connected {
+		s.audit.fail(sess, err)
+	}
+}
+
+// upgrade websocket from HTTP/1.1 upgrade or HTTP/2 extended CONNECT(RFC 8441), the
+// connection of HTTP/1.1 is counted for stats when compression is negotiated.
+func (s *server) upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	upgrader := *s.upgrader
+	upgrader.EnableCompression = s.runtime().cfg.compression
+	if ws.IsExtendedConnect(r) {
+		return ws.UpgradeH2(&upgrader, w, r)
+	}
+
+	if upgrader.EnableCompression && ws.Negotiated(r.Header) {
+		w = ws.MeterWire(w)
+	}
+	return upgrader.Upgrade(w, r, nil)
+}
+
+// streamRelay relay tcp data in http/2 post stream.
+func (s *server) streamRelay(w http.ResponseWriter, r *http.Request, sess *session) {
+	if r.ProtoMajor < 2 {
+		http.Error(w, "post tunnel requires HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	logger := logging.Default()
+	logger.Log(logging.LevelInfo, "receive tunnel request", "transport", "h2stream", "target", sess.target, "client", sess.sourceIP)
+
+	// closing request body break the upstream copy and end the stream.
+	sess.transport, sess.close = "h2stream", r.Body.Close
+	s.sessions.add(sess)
+	defer s.sessions.remove(sess)
+
+	_, password, _ := r.BasicAuth()
+	bridge, releaseBridge := s.newBridge(sess, password)
+	defer releaseBridge()
+	if err := bridge.HTTP2TCP(w, r, sess.target); err != nil {
+		s.tunnelFailed(sess, err)
+	}
+}
+
+// pollRelay relay tcp data in split upload/download requests.
+func (s *server) pollRelay(w http.ResponseWriter, r *http.Request, sess *session, release func()) {
+	rec := &statusRecorder{ResponseWriter: w}
+	defer func() {
+		// session is not opened.
+		if rec.status != http.StatusOK {
+			release()
+		}
+	}()
+
+	_, password, _ := r.BasicAuth()
+	s.poll.Serve(rec, r, sess.user, sess.target, func(c net.Conn) {
+		defer release()
+
+		logger := logging.Default()
+		logger.Log(logging.LevelInfo, "receive tunnel request", "transport", "poll", "target", sess.target, "client", sess.sourceIP)
+		defer c.Close()
+
+		sess.transport, sess.close = "poll", c.Close
+		s.sessions.add(sess)
+		defer s.sessions.remove(sess)
+
+		bridge, releaseBridge := s.newBridge(sess, password)
+		defer releaseBridge()
+		if err := bridge.Conn2TCP(c, sess.target); err != nil {
+			s.tunnelFailed(sess, err)
+		}
+	})
+}
+
+func usage(fs *flag.FlagSet) {
 	fmt.Fprintf(os.Stderr, "Usage: %s [options], options list:\n", os.Args[0])
-	flag.PrintDefaults()
+	fs.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "Tunnel target is the url path: /host:port for tcp, /udp:host:port for udp, /unix:/path for unix socket.")
 }
 
 func printVersion() {
 	fmt.Fprintln(os.Stdout, "Version:\t", version)
 	fmt.Fprintln(os.Stdout, "Build date:\t", buildDate)
 }
-
-func init() {
-	log.SetOutput(os.Stdout)
-}
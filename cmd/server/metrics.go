@@ -0,0 +1,14 @@
+package main
+
+import "github.com/wuhuizuo/tcpb/cmd/internal/metrics"
+
+const rejectedTunnelsHelp = "Tunnel requests rejected before opening sessions."
+
+// counters of rejected tunnel requests by reason.
+var (
+	rejectedSource       = metrics.NewCounter(`tcpb_rejected_tunnels_total{reason="source"}`, rejectedTunnelsHelp)
+	rejectedUnauthorized = metrics.NewCounter(`tcpb_rejected_tunnels_total{reason="unauthorized"}`, rejectedTunnelsHelp)
+	rejectedForbidden    = metrics.NewCounter(`tcpb_rejected_tunnels_total{reason="forbidden"}`, rejectedTunnelsHelp)
+	rejectedNotFound     = metrics.NewCounter(`tcpb_rejected_tunnels_total{reason="not_found"}`, rejectedTunnelsHelp)
+	rejectedLimit        = metrics.NewCounter(`tcpb_rejected_tunnels_total{reason="limit"}`, rejectedTunnelsHelp)
+)
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wuhuizuo/tcpb"
+)
+
+var (
+	errUnauthorized = errors.New("unauthorized")
+	errForbidden    = errors.New("target not allowed")
+
+	errSourceNotAllowed = errors.New("source ip not allowed")
+)
+
+// policy decide who can open tunnels to which targets and how long and much they can use.
+type policy struct {
+	users map[string]string // name -> password, no auth when empty.
+	allow []string          // target patterns, all targets allowed when empty.
+
+	maxDuration time.Duration // 0 for unlimited.
+	maxBytes    int64         // 0 for unlimited.
+	quotas      []quota
+
+	routes map[string]*route // name -> route, request paths are targets when empty.
+}
+
+// newPolicy return the policy of cfg, it should be validated.
+func newPolicy(cfg *serverCfg) *policy {
+	p := &policy{
+		users:       make(map[string]string),
+		allow:       cfg.allowTargets,
+		maxDuration: time.Duration(cfg.maxSessionDuration) * time.Second,
+		maxBytes:    cfg.maxSessionBytes,
+		routes:      make(map[string]*route),
+	}
+	for _, u := range cfg.users {
+		i := strings.Index(u, ":")
+		p.users[u[:i]] = u[i+1:]
+	}
+	for _, s := range cfg.sessionQuotas {
+		if q, err := parseQuota(s); err == nil {
+			p.quotas = append(p.quotas, q)
+		}
+	}
+	for _, s := range cfg.routes {
+		if rt, err := parseRoute(s); err == nil {
+			p.routes[rt.name] = rt
+		}
+	}
+
+	return p
+}
+
+// authorize check the credential and access of user from ip to the request
+// path, which is a route name when routes are configured, or the target. The
+// password is checked by its digest from passwordDigest. It returns the route
+// name and target, or errUnauthorized, errRouteNotFound or errForbidden.
+func (p *policy) authorize(user string, digest []byte, reqPath string, ip net.IP) (string, string, error) {
+	if err := p.verify(user, digest); err != nil {
+		return "", "", err
+	}
+
+	routeName, target, backends := "", reqPath, []string{reqPath}
+	if len(p.routes) > 0 {
+		rt, ok := p.routes[reqPath]
+		if !ok {
+			return "", "", errRouteNotFound
+		}
+		if err := rt.permit(user, ip); err != nil {
+			return "", "", err
+		}
+		routeName, target, backends = rt.name, rt.target, rt.backends
+	}
+
+	for _, b := range backends {
+		if !p.allowed(b) {
+			return "", "", errForbidden
+		}
+	}
+
+	return routeName, target, nil
+}
+
+// allowed check whether target match the allowed patterns, all tcp and udp targets
+// are allowed without patterns. Unix socket targets are opt-in: they need to match
+// a pattern starting with "unix:".
+func (p *policy) allowed(target string) bool {
+	network, _ := tcpb.ParseTarget(target)
+	if len(p.allow) == 0 {
+		return network != "unix"
+	}
+	for _, pattern := range p.allow {
+		if n, _ := tcpb.ParseTarget(pattern); network == "unix" && n != "unix" {
+			continue
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authenticate check the credential, it returns errUnauthorized.
+func (p *policy) authenticate(user, password string) error {
+	return p.verify(user, passwordDigest(password))
+}
+
+// verify check the credential by the password digest, it returns errUnauthorized.
+func (p *policy) verify(user string, digest []byte) error {
+	if len(p.users) == 0 {
+		return nil
+	}
+
+	expected, ok := p.users[user]
+	if !ok || subtle.ConstantTimeCompare(passwordDigest(expected), digest) != 1 {
+		return errUnauthorized
+	}
+
+	return nil
+}
+
+// digestKey is the random key of password digests, digests are only valid in the process.
+var digestKey = newDigestKey()
+
+func newDigestKey() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+
+	return key
+}
+
+// passwordDigest return the verifier of password, sessions keep it instead of the
+// password to be checked again after reload.
+func passwordDigest(password string) []byte {
+	mac := hmac.New(sha256.New, digestKey)
+	mac.Write([]byte(password))
+
+	return mac.Sum(nil)
+}
+
+// writePolicyError write the http response for errors from policy.authorize.
+func writePolicyError(w http.ResponseWriter, err error) {
+	switch err {
+	case errUnauthorized:
+		w.Header().Set("WWW-Authenticate", `Basic realm="tcpb"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case errRouteNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	http.Error(w, err.Error(), http.StatusForbidden)
+}
+
+func validPattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return errors.Errorf("invalid target pattern %q", pattern)
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// quota is the max duration and bytes of sessions of a user or to targets
+// matching a pattern, 0 for unlimited.
+type quota struct {
+	user        string
+	target      string // target pattern.
+	maxDuration time.Duration
+	maxBytes    int64
+}
+
+// parseQuota parse quota in format: (user=name|target=pattern)[,duration=seconds][,bytes=n].
+func parseQuota(s string) (quota, error) {
+	var q quota
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return q, errors.Errorf("invalid session quota field %q in %q", field, s)
+		}
+
+		switch key, value := kv[0], kv[1]; key {
+		case "user":
+			q.user = value
+		case "target":
+			if err := validPattern(value); err != nil {
+				return q, err
+			}
+			q.target = value
+		case "duration":
+			seconds, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return q, errors.Errorf("invalid session quota duration %q in %q", value, s)
+			}
+			q.maxDuration = time.Duration(seconds) * time.Second
+		case "bytes":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return q, errors.Errorf("invalid session quota bytes %q in %q", value, s)
+			}
+			q.maxBytes = n
+		default:
+			return q, errors.Errorf("unknown session quota field %q in %q", key, s)
+		}
+	}
+
+	if (q.user == "") == (q.target == "") {
+		return q, errors.Errorf("session quota %q should have one of user or target", s)
+	}
+
+	return q, nil
+}
+
+// match report whether the quota apply to sessions of user to target.
+func (q quota) match(user, target string) bool {
+	if q.user != "" {
+		return q.user == user
+	}
+
+	ok, _ := path.Match(q.target, target)
+	return ok
+}
+
+// sessionQuota return the strictest max duration and bytes of the global
+// limits and quotas matching user and target.
+func (p *policy) sessionQuota(user, target string) (time.Duration, int64) {
+	maxDuration, maxBytes := int64(p.maxDuration), p.maxBytes
+	for _, q := range p.quotas {
+		if !q.match(user, target) {
+			continue
+		}
+		maxDuration = minPositive(maxDuration, int64(q.maxDuration))
+		maxBytes = minPositive(maxBytes, q.maxBytes)
+	}
+
+	return time.Duration(maxDuration), maxBytes
+}
+
+// minPositive return the smaller one of a and b, 0 means unlimited.
+func minPositive(a, b int64) int64 {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+
+	return a
+}
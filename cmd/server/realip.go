@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/wuhuizuo/tcpb/cmd/internal/ipnet"
+)
+
+// headers carrying the client ip written by trusted proxies.
+const (
+	realIPForwarded    = "forwarded"
+	realIPForwardedFor = "x-forwarded-for"
+	realIPRealIP       = "x-real-ip"
+)
+
+// remoteIP return the ip of the remote address of r.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// realIP return the real client ip of r: when the peer is a trusted proxy, the
+// forwarding chain of header is walked from the nearest hop, the first address
+// not trusted is the client. Only the header written by the trusted proxies is
+// read, others may be sent by clients and passed through.
+func realIP(r *http.Request, trusted ipnet.Nets, header string) string {
+	peer := remoteIP(r)
+	ip := net.ParseIP(peer)
+	if ip == nil || !trusted.Contains(ip) {
+		return peer
+	}
+
+	chain := forwardedChain(r, header)
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := net.ParseIP(chain[i])
+		if hop == nil {
+			// the trusted proxy does not know the client, it is the nearest known one.
+			break
+		}
+		ip = hop
+		if !trusted.Contains(hop) {
+			break
+		}
+	}
+
+	return ip.String()
+}
+
+// forwardedChain return the client addresses added by proxies in header, one of
+// Forwarded, X-Forwarded-For and X-Real-IP, the nearest hop is the last, ports
+// and brackets are removed.
+func forwardedChain(r *http.Request, header string) []string {
+	var chain []string
+	switch header {
+	case realIPForwarded:
+		for _, v := range r.Header.Values("Forwarded") {
+			for _, elem := range strings.Split(v, ",") {
+				chain = append(chain, forwardedElemFor(elem))
+			}
+		}
+	case realIPForwardedFor:
+		for _, addr := range forwardedForChain(r) {
+			chain = append(chain, stripPort(addr))
+		}
+	case realIPRealIP:
+		// set by the nearest proxy, replacing any from the client.
+		if v := strings.TrimSpace(r.Header.Get("X-Real-IP")); v != "" {
+			chain = append(chain, stripPort(v))
+		}
+	}
+
+	return chain
+}
+
+// forwardedElemFor return the for parameter of a Forwarded element(RFC 7239),
+// empty when absent, obfuscated identifiers and "unknown" are returned as is.
+func forwardedElemFor(elem string) string {
+	for _, pair := range strings.Split(elem, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+			return stripPort(strings.Trim(kv[1], `"`))
+		}
+	}
+
+	return ""
+}
+
+// stripPort remove the port and brackets of an address like [::1]:80 or 1.2.3.4:80.
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return strings.Trim(addr, "[]")
+}
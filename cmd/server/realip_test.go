@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/wuhuizuo/tcpb/cmd/internal/ipnet"
+)
+
+func TestRealIP(t *testing.T) {
+	trusted, err := ipnet.Parse([]string{"10.0.0.0/8", "192.168.1.10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		header  string // header written by trusted proxies.
+		headers map[string]string
+		want    string
+	}{
+		{
+			name:    "untrusted peer",
+			remote:  "203.0.113.9:5000",
+			header:  realIPForwardedFor,
+			headers: map[string]string{"X-Forwarded-For": "1.1.1.1"},
+			want:    "203.0.113.9",
+		},
+		{
+			name:    "x-forwarded-for",
+			remote:  "10.0.0.1:5000",
+			header:  realIPForwardedFor,
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.7"},
+			want:    "198.51.100.7",
+		},
+		{
+			name:    "x-forwarded-for through trusted hops",
+			remote:  "10.0.0.1:5000",
+			header:  realIPForwardedFor,
+			headers: map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.7, 192.168.1.10:8080"},
+			want:    "198.51.100.7",
+		},
+		{
+			name:    "x-forwarded-for without header",
+			remote:  "10.0.0.1:5000",
+			header:  realIPForwardedFor,
+			headers: map[string]string{},
+			want:    "10.0.0.1",
+		},
+		{
+			name:   "spoofed forwarded with x-forwarded-for proxy",
+			remote: "10.0.0.1:5000",
+			header: realIPForwardedFor,
+			headers: map[string]string{
+				"Forwarded":       "for=1.1.1.1",
+				"X-Forwarded-For": "198.51.100.7",
+			},
+			want: "198.51.100.7",
+		},
+		{
+			name:   "spoofed x-real-ip with x-forwarded-for proxy",
+			remote: "10.0.0.1:5000",
+			header: realIPForwardedFor,
+			headers: map[string]string{
+				"X-Real-IP":       "1.1.1.1",
+				"X-Forwarded-For": "198.51.100.7",
+			},
+			want: "198.51.100.7",
+		},
+		{
+			name:   "spoofed forwarded with x-real-ip proxy",
+			remote: "10.0.0.1:5000",
+			header: realIPRealIP,
+			headers: map[string]string{
+				"Forwarded":       "for=1.1.1.1",
+				"X-Forwarded-For": "1.1.1.1",
+				"X-Real-IP":       "198.51.100.7",
+			},
+			want: "198.51.100.7",
+		},
+		{
+			name:    "spoofed x-forwarded-for only with x-real-ip proxy",
+			remote:  "10.0.0.1:5000",
+			header:  realIPRealIP,
+			headers: map[string]string{"X-Forwarded-For": "1.1.1.1"},
+			want:    "10.0.0.1",
+		},
+		{
+			name:   "forwarded",
+			remote: "10.0.0.1:5000",
+			header: realIPForwarded,
+			headers: map[string]string{
+				"Forwarded":       `for=1.1.1.1, for="[2001:db8::7]:4711";proto=https, for=192.168.1.10`,
+				"X-Forwarded-For": "1.1.1.1",
+			},
+			want: "2001:db8::7",
+		},
+		{
+			name:    "forwarded unknown client",
+			remote:  "10.0.0.1:5000",
+			header:  realIPForwarded,
+			headers: map[string]string{"Forwarded": "for=unknown, for=10.0.0.2"},
+			want:    "10.0.0.2",
+		},
+		{
+			name:    "spoofed x-forwarded-for with forwarded proxy",
+			remote:  "10.0.0.1:5000",
+			header:  realIPForwarded,
+			headers: map[string]string{"X-Forwarded-For": "1.1.1.1"},
+			want:    "10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/target", nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			if got := realIP(r, trusted, tt.header); got != tt.want {
+				t.Errorf("realIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wuhuizuo/tcpb/cmd/internal/ipnet"
+	"github.com/wuhuizuo/tcpb/logging"
+	netproxy "golang.org/x/net/proxy"
+)
+
+// runtime is the reloadable state of server, it is replaced as a whole on reload.
+type runtime struct {
+	cfg     *serverCfg
+	policy  *policy
+	trusted ipnet.Nets       // trusted proxies forwarding the client ip.
+	sources ipnet.Nets       // allowed client ips, all allowed when empty.
+	cert    *tls.Certificate // nil when serving without TLS.
+	dialer  netproxy.ContextDialer
+	vias    []*url.URL // tcpb servers to relay stream targets onward through.
+}
+
+func newRuntime(cfg *serverCfg) (*runtime, error) {
+	trusted, err := ipnet.Parse(cfg.trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := ipnet.Parse(cfg.allowSources)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer, err := newDialer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	vias, err := parseVias(cfg.vias)
+	if err != nil {
+		return nil, err
+	}
+
+	rt := &runtime{cfg: cfg, policy: newPolicy(cfg), trusted: trusted, sources: sources, dialer: dialer, vias: vias}
+	if cfg.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.certFile, cfg.keyFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		rt.cert = &cert
+	}
+
+	return rt, nil
+}
+
+// reload load config from command line args and config file again, new policies and
+// credentials apply to new tunnels, listen address and TLS enabling need a restart.
+func (s *server) reload() error {
+	cfg, _, err := loadConfig(s.args, flag.ContinueOnError)
+	if err != nil {
+		return err
+	}
+
+	old := s.runtime()
+	if cfg.host != old.cfg.host || cfg.port != old.cfg.port {
+		return errors.New("listen address can not be changed without restart")
+	}
+	if (cfg.certFile == "") != (old.cert == nil) {
+		return errors.New("TLS can not be enabled or disabled without restart")
+	}
+	if cfg.auditFile != old.cfg.auditFile {
+		return errors.New("audit file can not be changed without restart")
+	}
+
+	rt, err := newRuntime(cfg)
+	if err != nil {
+		return err
+	}
+	if err := setupLogging(cfg.logLevel, cfg.logFormat, logOutput(cfg.auditFile)); err != nil {
+		return err
+	}
+	s.rt.Store(rt)
+	s.backends.SetOptions(cfg.backendMaxFails, time.Duration(cfg.backendFailTimeout)*time.Second)
+	if rates := cfg.bandwidthRates(); rates != old.cfg.bandwidthRates() {
+		s.bandwidth.SetRates(rates)
+	}
+	logging.Default().Log(logging.LevelInfo, "config reloaded", "users", len(rt.policy.users), "allow-targets", len(rt.policy.allow), "routes", len(rt.policy.routes))
+
+	if cfg.reloadTerminate {
+		s.terminateDisallowed(rt)
+	}
+
+	return nil
+}
+
+// terminateDisallowed close live sessions which are not permitted by rt.
+func (s *server) terminateDisallowed(rt *runtime) {
+	for _, sess := range s.sessions.list() {
+		reqPath := sess.route
+		if reqPath == "" {
+			reqPath = sess.target
+		}
+		ip := net.ParseIP(sess.sourceIP)
+		err := errSourceNotAllowed
+		if rt.sources.Allow(ip) {
+			var target string
+			_, target, err = rt.policy.authorize(sess.user, sess.digest, reqPath, ip)
+			if err == nil && target != sess.target {
+				err = errRouteChanged
+			}
+		}
+		if err == nil {
+			continue
+		}
+
+		logging.Default().Log(logging.LevelWarn, "terminate session after reload", "session", sess.id, "user", sess.user, "target", sess.target, "reason", err)
+		_ = sess.close()
+	}
+}
+
+// watchReload reload config on SIGHUP, and on config file changes when interval > 0.
+func (s *server) watchReload(configFile string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if configFile != "" && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	lastMod := modTime(configFile)
+
+	for {
+		select {
+		case <-hup:
+			lastMod = modTime(configFile)
+		case <-tick:
+			mod := modTime(configFile)
+			if mod.Equal(lastMod) {
+				continue
+			}
+			lastMod = mod
+		}
+
+		if err := s.reload(); err != nil {
+			logging.Default().Log(logging.LevelError, "reload config failed, keep the running config", "err", err)
+		}
+	}
+}
+
+func modTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return fi.ModTime()
+}
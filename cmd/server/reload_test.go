@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestTerminateDisallowed(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string // config after reload.
+		user       string
+		password   string
+		sourceIP   string
+		target     string
+		wantClosed bool
+	}{
+		{
+			name:     "allowed",
+			args:     []string{"-user", "alice:secret", "-allow-source", "10.0.0.0/8"},
+			user:     "alice",
+			password: "secret",
+			sourceIP: "10.1.2.3",
+			target:   "127.0.0.1:22",
+		},
+		{
+			name:       "source removed",
+			args:       []string{"-user", "alice:secret", "-allow-source", "192.168.0.0/16"},
+			user:       "alice",
+			password:   "secret",
+			sourceIP:   "10.1.2.3",
+			target:     "127.0.0.1:22",
+			wantClosed: true,
+		},
+		{
+			name:     "sources cleared",
+			args:     []string{"-user", "alice:secret"},
+			user:     "alice",
+			password: "secret",
+			sourceIP: "10.1.2.3",
+			target:   "127.0.0.1:22",
+		},
+		{
+			name:       "password changed",
+			args:       []string{"-user", "alice:changed", "-allow-source", "10.0.0.0/8"},
+			user:       "alice",
+			password:   "secret",
+			sourceIP:   "10.1.2.3",
+			target:     "127.0.0.1:22",
+			wantClosed: true,
+		},
+		{
+			name:       "target removed",
+			args:       []string{"-user", "alice:secret", "-allow-target", "127.0.0.1:80"},
+			user:       "alice",
+			password:   "secret",
+			sourceIP:   "10.1.2.3",
+			target:     "127.0.0.1:22",
+			wantClosed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _, err := loadConfig(tt.args, flag.ContinueOnError)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rt, err := newRuntime(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			closed := false
+			s := &server{sessions: newSessionRegistry()}
+			s.sessions.add(&session{
+				user:     tt.user,
+				digest:   passwordDigest(tt.password),
+				target:   tt.target,
+				sourceIP: tt.sourceIP,
+				close:    func() error { closed = true; return nil },
+			})
+
+			s.terminateDisallowed(rt)
+			if closed != tt.wantClosed {
+				t.Errorf("session closed = %v, want %v", closed, tt.wantClosed)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/wuhuizuo/tcpb"
+	"github.com/wuhuizuo/tcpb/balance"
+	"github.com/wuhuizuo/tcpb/cmd/internal/ipnet"
+)
+
+// routesPath list routes the user can access.
+const routesPath = "/routes"
+
+var (
+	errRouteNotFound = errors.New("route not found")
+	errRouteChanged  = errors.New("route target changed")
+)
+
+// route is a named target, the request path is the name instead of the target.
+type route struct {
+	name     string
+	target   string   // backends joined with comma, for logs, limits and quotas.
+	backends []string // stream targets balanced when more than one.
+	balance  balance.Strategy
+	users    []string   // users allowed, all users when empty.
+	sources  ipnet.Nets // client ips allowed, all when empty.
+}
+
+// parseRoute parse route in format:
+// name=name,target=target[,target=target...][,balance=strategy][,user=name...][,source=CIDR...].
+func parseRoute(s string) (*route, error) {
+	rt := &route{}
+	var sources []string
+	var strategy string
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, errors.Errorf("invalid route field %q in %q", field, s)
+		}
+
+		switch key, value := kv[0], kv[1]; key {
+		case "name":
+			rt.name = strings.Trim(value, "/")
+		case "target":
+			rt.backends = append(rt.backends, value)
+		case "balance":
+			strategy = value
+		case "user":
+			rt.users = append(rt.users, value)
+		case "source":
+			sources = append(sources, value)
+		default:
+			return nil, errors.Errorf("unknown route field %q in %q", key, s)
+		}
+	}
+
+	if rt.name == "" || len(rt.backends) == 0 {
+		return nil, errors.Errorf("route %q should have name and target", s)
+	}
+	rt.target = strings.Join(rt.backends, ",")
+	if len(rt.backends) > 1 {
+		for _, b := range rt.backends {
+			if network, _ := tcpb.ParseTarget(b); network == "udp" {
+				return nil, errors.Errorf("route %q: udp target %q can not be balanced", rt.name, b)
+			}
+		}
+	}
+	switch "/" + rt.name {
+	case routesPath, healthPath, readyPath:
+		return nil, errors.Errorf("route name %q is reserved", rt.name)
+	}
+
+	var err error
+	if rt.balance, err = balance.ParseStrategy(strategy); err != nil {
+		return nil, errors.Wrapf(err, "route %q", rt.name)
+	}
+	if rt.sources, err = ipnet.Parse(sources); err != nil {
+		return nil, errors.Wrapf(err, "route %q", rt.name)
+	}
+
+	return rt, nil
+}
+
+// permit check whether user from ip can access the route, it returns errForbidden.
+func (rt *route) permit(user string, ip net.IP) error {
+	if !rt.sources.Allow(ip) {
+		return errForbidden
+	}
+	if len(rt.users) == 0 {
+		return nil
+	}
+	for _, u := range rt.users {
+		if u == user {
+			return nil
+		}
+	}
+
+	return errForbidden
+}
+
+// balanced report whether the route has several backends to balance.
+func (rt *route) balanced() bool {
+	return len(rt.backends) > 1
+}
+
+// routeInfo is a route listed to users, targets are not exposed.
+type routeInfo struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"` // tcp for stream targets or udp.
+}
+
+// listRoutes serve the routes the user can access as json.
+func (s *server) listRoutes(w http.ResponseWriter, r *http.Request) {
+	rt := s.runtime()
+	clientIP := realIP(r, rt.trusted, rt.cfg.trustedHeader)
+	if !rt.sources.Allow(net.ParseIP(clientIP)) {
+		http.Error(w, errSourceNotAllowed.Error(), http.StatusForbidden)
+		return
+	}
+
+	user, password, _ := r.BasicAuth()
+	if err := rt.policy.authenticate(user, password); err != nil {
+		writePolicyError(w, err)
+		return
+	}
+
+	infos := []routeInfo{}
+	for _, route := range rt.policy.routes {
+		if route.permit(user, net.ParseIP(clientIP)) != nil {
+			continue
+		}
+
+		protocol := "tcp"
+		if network, _ := tcpb.ParseTarget(route.backends[0]); network == "udp" {
+			protocol = "udp"
+		}
+		infos = append(infos, routeInfo{Name: route.name, Protocol: protocol})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"routes": infos})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wuhuizuo/tcpb/balance"
+	"github.com/wuhuizuo/tcpb/proxyproto"
+)
+
+// client address sources of PROXY headers sent to targets.
+const (
+	proxySourceRemote    = "remote"
+	proxySourceForwarded = "x-forwarded-for"
+)
+
+// session is a live tunnel served by the server.
+type session struct {
+	id        uint64
+	transport string
+	user      string
+	digest    []byte // password digest of the user, see passwordDigest.
+	route     string // route name, empty when the target is requested directly.
+	target    string
+	backends  *balance.Group // backends of a balanced route, nil for a single target.
+	remote    string
+	started   time.Time
+
+	sourceIP     string   // real client ip, forwarded by trusted proxies.
+	forwardedFor []string // X-Forwarded-For chain.
+	local        net.Addr // address the request is received on.
+	connected    bool     // set when the target is connected and the session started.
+
+	close  func() error // terminate the tunnel.
+	goAway func() error // ask the peer to close the tunnel, nil when unsupported by transport.
+}
+
+// proxyHeader return the PROXY header carrying the client address from source
+// and the local address, the port is 0 when the client ip is forwarded by proxies.
+func (s *session) proxyHeader(version uint, source string) *proxyproto.Header {
+	h := &proxyproto.Header{Version: int(version), Destination: s.local}
+	host, port, err := net.SplitHostPort(s.remote)
+	if err != nil {
+		return h
+	}
+
+	p, _ := strconv.Atoi(port)
+	h.Source = &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+	if source == proxySourceForwarded && s.sourceIP != host {
+		h.Source = &net.TCPAddr{IP: net.ParseIP(s.sourceIP)}
+	}
+
+	return h
+}
+
+// balanceKey return the client identity for consistent hashing, the user or the client ip.
+func (s *session) balanceKey() string {
+	if s.user != "" {
+		return s.user
+	}
+
+	return s.sourceIP
+}
+
+// sessionRegistry track live sessions.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	nextID   uint64
+	sessions map[uint64]*session
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[uint64]*session)}
+}
+
+func (r *sessionRegistry) add(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	s.id = r.nextID
+	r.sessions[s.id] = s
+}
+
+func (r *sessionRegistry) remove(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.sessions, s.id)
+}
+
+func (r *sessionRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.sessions)
+}
+
+// list return a snapshot of live sessions.
+func (r *sessionRegistry) list() []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ret := make([]*session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		ret = append(ret, s)
+	}
+
+	return ret
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/wuhuizuo/tcpb/logging"
+)
+
+const (
+	drainCheckInterval = 100 * time.Millisecond
+	forceCloseTimeout  = 5 * time.Second
+)
+
+func (s *server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// shutdown stop accepting tunnels, ask websocket peers to go away and wait live
+// sessions to finish until ctx done, remaining sessions are closed by force.
+func (s *server) shutdown(ctx context.Context) {
+	atomic.StoreInt32(&s.draining, 1)
+
+	logger := logging.Default()
+	logger.Log(logging.LevelInfo, "draining", "sessions", s.sessions.count())
+	for _, sess := range s.sessions.list() {
+		if sess.goAway == nil {
+			continue
+		}
+		if err := sess.goAway(); err != nil {
+			logger.Log(logging.LevelDebug, "send going away failed", "session", sess.id, "err", err)
+		}
+	}
+
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+wait:
+	for s.sessions.count() > 0 {
+		select {
+		case <-ctx.Done():
+			for _, sess := range s.sessions.list() {
+				logger.Log(logging.LevelWarn, "close session by force", "session", sess.id, "transport", sess.transport, "target", sess.target, "remote", sess.remote)
+				_ = sess.close()
+			}
+			break wait
+		case <-ticker.C:
+		}
+	}
+
+	closeCtx, cancel := context.WithTimeout(context.Background(), forceCloseTimeout)
+	defer cancel()
+	if err := s.srv.Shutdown(closeCtx); err != nil {
+		_ = s.srv.Close()
+	}
+	logger.Log(logging.LevelInfo, "drained")
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wuhuizuo/tcpb/proxy"
+	netproxy "golang.org/x/net/proxy"
+)
+
+// parseVias parse the urls of tcpb servers to relay onward through.
+func parseVias(vias []string) ([]*url.URL, error) {
+	var hops []*url.URL
+	for _, via := range vias {
+		u, err := url.Parse(via)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		switch u.Scheme {
+		case proxy.SchemeWebsocket, proxy.SchemeWebsocketSec, proxy.SchemeHTTP, proxy.SchemeHTTPS:
+		default:
+			return nil, errors.Errorf("unsupported scheme %q of %q", u.Scheme, via)
+		}
+		hops = append(hops, u)
+	}
+
+	return hops, nil
+}
+
+// targetDialer return the dialer of targets, relaying through via hops when set
+// with the credential of user carried to them.
+func (rt *runtime) targetDialer(user, password string) netproxy.ContextDialer {
+	if len(rt.vias) == 0 {
+		return rt.dialer
+	}
+
+	return &viaDialer{
+		hops:     rt.vias,
+		user:     user,
+		password: password,
+		forward:  rt.dialer,
+		timeout:  time.Duration(rt.cfg.dialTimeout) * time.Second,
+		insecure: rt.cfg.viaInsecure,
+	}
+}
+
+// viaDialer relay stream targets onward through tcpb servers of hops, the target
+// is the tunnel path of the last hop. The client credential is carried to hops
+// without auth in url, so the next servers authenticate the client end to end.
+// TLS certificates of hops are verified, credentials are only carried to https
+// and wss hops unless insecure. Udp targets can not be relayed.
+type viaDialer struct {
+	hops           []*url.URL
+	user, password string
+	forward        netproxy.ContextDialer // dialer of the first hop.
+	timeout        time.Duration
+	insecure       bool // skip verifying hops and carry credentials to plaintext hops.
+}
+
+func (d *viaDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if strings.HasPrefix(network, "udp") {
+		return nil, errUDPVia
+	}
+
+	hops := make([]*url.URL, len(d.hops))
+	for i, hop := range d.hops {
+		u := *hop
+		if u.User == nil && d.user != "" && (d.insecure || isTLSScheme(u.Scheme)) {
+			u.User = url.UserPassword(d.user, d.password)
+		}
+		hops[i] = &u
+	}
+
+	cfg := proxy.DefaultConfig(hops[0])
+	cfg.HTTPMethod = http.MethodPost
+	cfg.Base.TLSClientConfig = &tls.Config{InsecureSkipVerify: d.insecure}
+	cfg.Base.DialTimeout = d.timeout
+	chain, err := proxy.Chain(hops, forwardDialer{ctx, d.forward}, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	target := address
+	if network == "unix" {
+		target = "unix:" + address
+	}
+	c, err := proxy.WithContext(chain).DialContext(ctx, "tcp", target)
+	if err != nil {
+		return nil, err
+	}
+
+	return relayed(c, network, address), nil
+}
+
+// isTLSScheme report whether hops of scheme are dialed over TLS.
+func isTLSScheme(scheme string) bool {
+	return scheme == proxy.SchemeHTTPS || scheme == proxy.SchemeWebsocketSec
+}
+
+// forwardDialer dial the first hop with the context of the relayed dialing.
+type forwardDialer struct {
+	ctx context.Context
+	netproxy.ContextDialer
+}
+
+func (d forwardDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(d.ctx, network, address)
+}
@@ -1,9 +1,11 @@
 module github.com/wuhuizuo/tcpb
 
-go 1.15
+go 1.18
 
 require (
 	github.com/gorilla/websocket v1.4.2
 	github.com/pkg/errors v0.9.1
-	golang.org/x/net v0.0.0-20210316092652-d523dce5a7f4
+	golang.org/x/net v0.35.0
 )
+
+require golang.org/x/text v0.22.0 // indirect
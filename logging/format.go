@@ -0,0 +1,150 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// time layout of log records.
+const timeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// Format of log records.
+type Format string
+
+// log formats.
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
+// New return a logger writing records in format to w, records below level are dropped.
+func New(w io.Writer, format Format, level Level) (Logger, error) {
+	switch format {
+	case FormatText, "":
+		return NewTextLogger(w, level), nil
+	case FormatJSON:
+		return NewJSONLogger(w, level), nil
+	default:
+		return nil, errors.Errorf("unknown log format: %s", format)
+	}
+}
+
+// NewTextLogger return a logger writing lines like:
+//
+//	2021-03-16T09:00:00.000+08:00 [WARN ] disconnected from=127.0.0.1:5000 err="EOF"
+func NewTextLogger(w io.Writer, level Level) Logger {
+	return &writerLogger{w: w, level: level, encode: encodeText}
+}
+
+// NewJSONLogger return a logger writing one json object per line like:
+//
+//	{"time":"2021-03-16T09:00:00.000+08:00","level":"WARN","msg":"disconnected","from":"127.0.0.1:5000"}
+func NewJSONLogger(w io.Writer, level Level) Logger {
+	return &writerLogger{w: w, level: level, encode: encodeJSON}
+}
+
+type writerLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	level  Level
+	encode func(buf *bytes.Buffer, t time.Time, level Level, msg string, keyvals []interface{})
+}
+
+// Log implement Logger.
+func (l *writerLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	if level < l.level {
+		return
+	}
+
+	var buf bytes.Buffer
+	l.encode(&buf, time.Now(), level, msg, keyvals)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(buf.Bytes())
+}
+
+func encodeText(buf *bytes.Buffer, t time.Time, level Level, msg string, keyvals []interface{}) {
+	fmt.Fprintf(buf, "%s [%-5s] %s", t.Format(timeLayout), level, msg)
+
+	for i := 0; i < len(keyvals); i += 2 {
+		key, val := keyval(keyvals, i)
+		s := fmt.Sprint(val)
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			s = strconv.Quote(s)
+		}
+		fmt.Fprintf(buf, " %s=%s", key, s)
+	}
+	buf.WriteByte('\n')
+}
+
+func encodeJSON(buf *bytes.Buffer, t time.Time, level Level, msg string, keyvals []interface{}) {
+	buf.WriteString(`{"time":`)
+	writeJSON(buf, t.Format(timeLayout))
+	buf.WriteString(`,"level":`)
+	writeJSON(buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSON(buf, msg)
+
+	for i := 0; i < len(keyvals); i += 2 {
+		key, val := keyval(keyvals, i)
+		buf.WriteByte(',')
+		writeJSON(buf, key)
+		buf.WriteByte(':')
+		writeJSON(buf, val)
+	}
+	buf.WriteString("}\n")
+}
+
+// keyval return the key and value at i, value is converted for printing.
+func keyval(keyvals []interface{}, i int) (string, interface{}) {
+	key := fmt.Sprint(keyvals[i])
+	if i+1 >= len(keyvals) {
+		return key, "(MISSING)"
+	}
+
+	switch v := keyvals[i+1].(type) {
+	case error:
+		if isNil(v) {
+			return key, nil
+		}
+		return key, v.Error()
+	case time.Duration:
+		return key, v.String()
+	case fmt.Stringer:
+		if isNil(v) {
+			return key, nil
+		}
+		return key, v.String()
+	default:
+		return key, v
+	}
+}
+
+// isNil check whether v is a typed nil, calling its methods may panic.
+func isNil(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface, reflect.Func, reflect.Chan:
+		return rv.IsNil()
+	default:
+		return false
+	}
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		bs, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(bs)
+}
@@ -0,0 +1,102 @@
+// Package logging implement the pluggable leveled logger with key/value fields for tcpb packages.
+package logging
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Level of log records.
+type Level int
+
+// log levels.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String implement fmt.Stringer.
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// ParseLevel parse level name: debug|info|warn|error.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, errors.Errorf("unknown log level: %s", s)
+	}
+}
+
+// Logger is the structured logger used by tcpb packages,
+// keyvals are alternating keys and values: "target", "127.0.0.1:22", "err", err.
+type Logger interface {
+	Log(level Level, msg string, keyvals ...interface{})
+}
+
+var (
+	defaultMu     sync.RWMutex
+	defaultLogger Logger = NewTextLogger(os.Stdout, LevelInfo)
+)
+
+// Default return the logger used when no logger is set.
+func Default() Logger {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+
+	return defaultLogger
+}
+
+// SetDefault replace the logger used when no logger is set.
+func SetDefault(l Logger) {
+	if l == nil {
+		l = Nop()
+	}
+
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	defaultLogger = l
+}
+
+// Or return l, or the default logger when l is nil.
+func Or(l Logger) Logger {
+	if l == nil {
+		return Default()
+	}
+
+	return l
+}
+
+// Nop return a logger discarding all records.
+func Nop() Logger {
+	return nopLogger{}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(Level, string, ...interface{}) {}
@@ -34,8 +34,8 @@ type Dialer struct {
 	Password string
 }
 
-// NewRawConn create a raw connection with http(s) proxy.
-func (d *Dialer) NewRawConn(network string) (net.Conn, error) {
+// ProxyAddr return the host:port address of the proxy server.
+func (d *Dialer) ProxyAddr() string {
 	proxyAddr := d.URL.Host
 	if d.URL.Port() == "" {
 		if d.URL.Scheme == "http" {
@@ -46,7 +46,12 @@ func (d *Dialer) NewRawConn(network string) (net.Conn, error) {
 		}
 	}
 
-	nc, err := d.Forward.Dial(network, proxyAddr)
+	return proxyAddr
+}
+
+// NewRawConn create a raw connection with http(s) proxy.
+func (d *Dialer) NewRawConn(network string) (net.Conn, error) {
+	nc, err := d.Forward.Dial(network, d.ProxyAddr())
 	if nil != err {
 		return nil, err
 	}
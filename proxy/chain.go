@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+// Chain return the dialer through tcpb servers of hops in order: every hop is
+// dialed on the tunnel connection of the previous one, the first with forward.
+// The target path of a hop defaults to the address of the next hop when empty,
+// and to the dialed address for the last hop. Auth in hop urls is for the hop itself.
+func Chain(hops []*url.URL, forward proxy.Dialer, cfg *Config) (proxy.Dialer, error) {
+	if len(hops) == 0 {
+		return nil, errors.New("no hop in chain")
+	}
+
+	d := forward
+	for i, hop := range hops[:len(hops)-1] {
+		u := *hop
+		if strings.Trim(u.Path, "/") == "" {
+			u.Path = "/" + HostPort(hops[i+1])
+		}
+
+		var err error
+		if d, err = FromURLWithConfig(&u, d, cfg); err != nil {
+			return nil, errors.Wrapf(err, "hop %d", i+1)
+		}
+	}
+
+	return &chainDialer{forward: d, last: hops[len(hops)-1], cfg: cfg}, nil
+}
+
+// chainDialer dial the last hop of chain for every address.
+type chainDialer struct {
+	forward proxy.Dialer
+	last    *url.URL
+	cfg     *Config
+}
+
+func (d *chainDialer) Dial(network, address string) (net.Conn, error) {
+	u := *d.last
+	if strings.Trim(u.Path, "/") == "" {
+		u.Path = "/" + address
+	}
+
+	last, err := FromURLWithConfig(&u, d.forward, d.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return last.Dial("tcp", address)
+}
+
+// HostPort return the host:port of u with the default port of its scheme.
+func HostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+
+	switch u.Scheme {
+	case SchemeHTTPS, SchemeWebsocketSec:
+		return net.JoinHostPort(u.Hostname(), "443")
+	default:
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+}
+
+// WithContext return d as proxy.ContextDialer, dialing of dialers without context
+// support is abandoned when ctx is done and the late connection is closed.
+func WithContext(d proxy.Dialer) proxy.ContextDialer {
+	if cd, ok := d.(proxy.ContextDialer); ok {
+		return cd
+	}
+
+	return contextDialer{d}
+}
+
+type contextDialer struct {
+	proxy.Dialer
+}
+
+func (d contextDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	type result struct {
+		c   net.Conn
+		err error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		c, err := d.Dial(network, address)
+		done <- result{c, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.c, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.c != nil {
+				r.c.Close()
+			}
+		}()
+		return nil, errors.WithStack(ctx.Err())
+	}
+}
@@ -5,10 +5,14 @@ import (
 	"net/http"
 	"net/url"
 	"time"
+
+	"github.com/wuhuizuo/tcpb/logging"
+	"github.com/wuhuizuo/tcpb/proxy/websocket"
 )
 
 // time duration consts.
 const (
+	// Deprecated: DefaultConfig does not set a dial timeout.
 	DefaultDiaTimeout      = 1 * time.Second
 	DefaultWSHeartInterval = 30 * time.Second
 )
@@ -24,9 +28,13 @@ var supportedSchemes = map[string]bool{
 // Config for proxy.
 type Config struct {
 	Base            BaseConfig
-	WSHeartInterval time.Duration // websocket part: interval for websocket send ping package to keep alive.
+	WSHeartInterval time.Duration         // websocket part: interval for websocket send ping package to keep alive.
+	WSCompression   websocket.Compression // websocket part: permessage-deflate offered to servers.
+
+	HTTPMethod string // http part: which method to use for dialing: CONNECT|POST|POLL, default: CONNECT.
+	HTTP2      bool   // dial tunnels as streams on a shared HTTP/2 connection, for POST method or wss with extended CONNECT.
 
-	HTTPMethod string // http part: which method to use for dialing, default: CONNECT.
+	Logger logging.Logger // logger for dialers, logging.Default() when nil.
 }
 
 // BaseConfig for proxy.
@@ -36,12 +44,11 @@ type BaseConfig struct {
 	DialTimeout     time.Duration // proxy dial timeout
 }
 
-// DefaultConfig return default config for common using, tls will skip tls verify.
+// DefaultConfig return default config for common using, tls will skip tls verify
+// and dialing has no timeout. The tls server name is left to the host of every
+// url dialed with the config.
 func DefaultConfig(u *url.URL) *Config {
 	ret := &Config{
-		Base: BaseConfig{
-			DialTimeout: DefaultDiaTimeout,
-		},
 		WSHeartInterval: DefaultWSHeartInterval,
 		HTTPMethod:      http.MethodConnect,
 	}
@@ -49,10 +56,7 @@ func DefaultConfig(u *url.URL) *Config {
 	// set tls.
 	switch u.Scheme {
 	case SchemeHTTPS, SchemeWebsocketSec:
-		ret.Base.TLSClientConfig = &tls.Config{
-			ServerName:         u.Hostname(),
-			InsecureSkipVerify: true,
-		}
+		ret.Base.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	default:
 		// nothing
 	}
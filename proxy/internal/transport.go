@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// maxH2Transports bound the shared transports, the evicted keep serving their streams.
+const maxH2Transports = 64
+
+// unsharedIdleTimeout close the connection of an unshared transport after its tunnel.
+const unsharedIdleTimeout = time.Second
+
+// H2Key identify the shared http/2 transport of dialers: tunnels share a connection
+// only when they dial the same server the same way.
+type H2Key struct {
+	Addr    string      // scheme://host:port of the server.
+	Forward interface{} // see DialerKey.
+	TLS     string      // see TLSKey.
+	Timeout time.Duration
+}
+
+// NewH2Key return the key of dialing addr with forward, tlsCfg and timeout, false
+// when the dialing can not be identified and must not share a transport.
+func NewH2Key(addr string, forward interface{}, tlsCfg *tls.Config, timeout time.Duration) (H2Key, bool) {
+	dk, ok := DialerKey(forward)
+	if !ok {
+		return H2Key{}, false
+	}
+	tk, ok := TLSKey(tlsCfg)
+	if !ok {
+		return H2Key{}, false
+	}
+
+	return H2Key{Addr: addr, Forward: dk, TLS: tk, Timeout: timeout}, true
+}
+
+// DialerKey return d as the map key identifying it, false when d can not be a map key.
+func DialerKey(d interface{}) (interface{}, bool) {
+	if d == nil {
+		return nil, true
+	}
+
+	return d, hashable(reflect.ValueOf(d))
+}
+
+// hashable report whether v can be a map key without panic, comparable structs
+// and arrays still panic on hashing fields holding uncomparable values.
+func hashable(v reflect.Value) bool {
+	if !v.Type().Comparable() {
+		return false
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		return v.IsNil() || hashable(v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !hashable(v.Field(i)) {
+				return false
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if !hashable(v.Index(i)) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// TLSKey return the identity of the settings in c used by dialing, false when c
+// has callbacks or other settings that can not be identified. Root CAs are
+// identified by the pool, client certificates by their contents.
+func TLSKey(c *tls.Config) (string, bool) {
+	if c == nil {
+		return "", true
+	}
+	if c.VerifyPeerCertificate != nil || c.VerifyConnection != nil || c.GetClientCertificate != nil ||
+		c.ClientSessionCache != nil || c.KeyLogWriter != nil || c.Rand != nil || c.Time != nil {
+		return "", false
+	}
+
+	h := sha256.New()
+	for _, cert := range c.Certificates {
+		for _, der := range cert.Certificate {
+			_, _ = h.Write(der)
+		}
+		_, _ = h.Write([]byte{0})
+	}
+
+	return fmt.Sprintf("%s|%t|%p|%x|%d|%d|%v|%v|%d", c.ServerName, c.InsecureSkipVerify, c.RootCAs, h.Sum(nil),
+		c.MinVersion, c.MaxVersion, c.CipherSuites, c.CurvePreferences, c.Renegotiation), true
+}
+
+// H2Transports cache shared http/2 transports by H2Key.
+type H2Transports struct {
+	mu sync.Mutex
+	m  map[H2Key]*http2.Transport
+}
+
+// Get return the transport of key, it is created by newTransport when missing.
+// Unshared transports are created for each call when shared is false.
+func (c *H2Transports) Get(key H2Key, shared bool, newTransport func() *http2.Transport) *http2.Transport {
+	if !shared {
+		t := newTransport()
+		t.IdleConnTimeout = unsharedIdleTimeout
+		return t
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t, ok := c.m[key]; ok {
+		return t
+	}
+	if c.m == nil {
+		c.m = make(map[H2Key]*http2.Transport)
+	}
+	if len(c.m) >= maxH2Transports {
+		for k, t := range c.m {
+			t.CloseIdleConnections()
+			delete(c.m, k)
+			break
+		}
+	}
+
+	t := newTransport()
+	c.m[key] = t
+
+	return t
+}
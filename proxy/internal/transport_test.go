@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+)
+
+type sliceDialer struct{ addrs []string }
+
+type wrapDialer struct{ inner interface{} }
+
+func TestNewH2Key(t *testing.T) {
+	pool := x509.NewCertPool()
+	verify := func([][]byte, [][]*x509.Certificate) error { return nil }
+
+	tests := []struct {
+		name       string
+		forward    interface{}
+		tls        *tls.Config
+		wantShared bool
+	}{
+		{name: "defaults", wantShared: true},
+		{name: "comparable dialer", forward: &net.Dialer{}, tls: &tls.Config{RootCAs: pool}, wantShared: true},
+		{name: "uncomparable dialer", forward: sliceDialer{}},
+		{name: "comparable dialer holding uncomparable", forward: wrapDialer{inner: sliceDialer{}}},
+		{name: "verify callback", tls: &tls.Config{VerifyPeerCertificate: verify}},
+		{name: "client certificate callback", tls: &tls.Config{GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return nil, nil }}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, shared := NewH2Key("https://a:443", tt.forward, tt.tls, 0); shared != tt.wantShared {
+				t.Errorf("shared = %v, want %v", shared, tt.wantShared)
+			}
+		})
+	}
+}
+
+func TestTLSKey(t *testing.T) {
+	certA := tls.Certificate{Certificate: [][]byte{[]byte("a")}}
+	certB := tls.Certificate{Certificate: [][]byte{[]byte("b")}}
+
+	tests := []struct {
+		name     string
+		a, b     *tls.Config
+		wantSame bool
+	}{
+		{name: "same settings", a: &tls.Config{ServerName: "a"}, b: &tls.Config{ServerName: "a"}, wantSame: true},
+		{name: "same certificates", a: &tls.Config{Certificates: []tls.Certificate{certA}}, b: &tls.Config{Certificates: []tls.Certificate{certA}}, wantSame: true},
+		{name: "different certificates", a: &tls.Config{Certificates: []tls.Certificate{certA}}, b: &tls.Config{Certificates: []tls.Certificate{certB}}},
+		{name: "different root pools", a: &tls.Config{RootCAs: x509.NewCertPool()}, b: &tls.Config{RootCAs: x509.NewCertPool()}},
+		{name: "different verification", a: &tls.Config{}, b: &tls.Config{InsecureSkipVerify: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := TLSKey(tt.a)
+			b, _ := TLSKey(tt.b)
+			if same := a == b; same != tt.wantSame {
+				t.Errorf("same key = %v, want %v", same, tt.wantSame)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package poll
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wuhuizuo/tcpb/proxy/post"
+
+	"github.com/pkg/errors"
+)
+
+// clientConn wrapper split upload/download requests of a session as net.Conn.
+type clientConn struct {
+	d      *Dialer
+	client *http.Client
+	id     string
+
+	writeMu sync.Mutex
+	upSeq   uint64
+
+	downR *io.PipeReader
+	downW *io.PipeWriter
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+func newClientConn(d *Dialer, client *http.Client, id string) *clientConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &clientConn{
+		d:      d,
+		client: client,
+		id:     id,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	c.downR, c.downW = io.Pipe()
+	go c.downloadLoop()
+
+	return c
+}
+
+// Read implement net.Conn.
+func (c *clientConn) Read(b []byte) (int, error) {
+	return c.downR.Read(b)
+}
+
+// Write implement net.Conn, data is uploaded in chunks with sequence numbers.
+func (c *clientConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		end := written + maxChunkLen
+		if end > len(b) {
+			end = len(b)
+		}
+
+		if err := c.upload(c.upSeq, b[written:end]); err != nil {
+			return written, err
+		}
+		c.upSeq++
+		written = end
+	}
+
+	return written, nil
+}
+
+// upload send a chunk, retry with the same sequence number on temporary failures.
+func (c *clientConn) upload(seq uint64, chunk []byte) error {
+	var err error
+	for i := 0; i < maxRetries; i++ {
+		if i > 0 && !c.backoff(i) {
+			return io.ErrClosedPipe
+		}
+
+		var resp *http.Response
+		resp, err = c.do(http.MethodPost, seq, chunk)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusNoContent:
+			return nil
+		case resp.StatusCode == http.StatusGone:
+			return io.ErrClosedPipe
+		case resp.StatusCode >= http.StatusInternalServerError:
+			err = errors.Errorf("upload failed: %v", resp.Status)
+		default:
+			return errors.Errorf("upload failed: %v", resp.Status)
+		}
+	}
+
+	return err
+}
+
+// downloadLoop fetch download data with long polling requests.
+func (c *clientConn) downloadLoop() {
+	seq := uint64(1)
+	failures := 0
+
+	for c.ctx.Err() == nil {
+		resp, err := c.do(http.MethodGet, seq, nil)
+		if err != nil {
+			if failures++; failures >= maxRetries {
+				_ = c.downW.CloseWithError(err)
+				return
+			}
+			c.backoff(failures)
+			continue
+		}
+
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		switch {
+		case err != nil:
+			failures++
+		case resp.StatusCode == http.StatusOK:
+			failures = 0
+			seq++
+			if _, err := c.downW.Write(data); err != nil {
+				return
+			}
+		case resp.StatusCode == http.StatusNoContent:
+			failures = 0
+		case resp.StatusCode == http.StatusGone:
+			_ = c.downW.Close()
+			return
+		case resp.StatusCode >= http.StatusInternalServerError:
+			// the same sequence is polled again, the server resends the chunk if it was lost.
+			failures++
+			err = errors.Errorf("download failed: %v", resp.Status)
+		default:
+			_ = c.downW.CloseWithError(errors.Errorf("download failed: %v", resp.Status))
+			return
+		}
+
+		if failures >= maxRetries {
+			_ = c.downW.CloseWithError(err)
+			return
+		}
+		if failures > 0 {
+			c.backoff(failures)
+		}
+	}
+}
+
+// backoff wait before retrying after failures, the delay is doubled from retryDelay
+// for every failure up to maxRetryDelay. It returns false when the connection closed.
+func (c *clientConn) backoff(failures int) bool {
+	delay := maxRetryDelay
+	if failures < 8 {
+		if d := retryDelay << uint(failures-1); d < delay {
+			delay = d
+		}
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+func (c *clientConn) do(method string, seq uint64, body []byte) (*http.Response, error) {
+	req, err := c.d.newRequest(method, c.id, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(HeaderSeq, strconv.FormatUint(seq, 10))
+
+	return c.client.Do(req.WithContext(c.ctx))
+}
+
+// Close implement net.Conn.
+func (c *clientConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		_ = c.downR.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, err := c.d.newRequest(http.MethodDelete, c.id, nil)
+		if err != nil {
+			return
+		}
+		if resp, err := c.client.Do(req.WithContext(ctx)); err == nil {
+			resp.Body.Close()
+		}
+	})
+
+	return nil
+}
+
+// LocalAddr implement net.Conn.
+func (c *clientConn) LocalAddr() net.Addr { return post.StreamAddr{Net: "poll"} }
+
+// RemoteAddr implement net.Conn.
+func (c *clientConn) RemoteAddr() net.Addr { return post.StreamAddr{Net: "poll", Addr: c.d.ProxyAddr()} }
+
+// SetDeadline implement net.Conn, it does nothing.
+func (c *clientConn) SetDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline implement net.Conn, it does nothing.
+func (c *clientConn) SetReadDeadline(t time.Time) error { return nil }
+
+// SetWriteDeadline implement net.Conn, it does nothing.
+func (c *clientConn) SetWriteDeadline(t time.Time) error { return nil }
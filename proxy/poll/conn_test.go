@@ -0,0 +1,170 @@
+package poll
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wuhuizuo/tcpb/proxy/base"
+
+	"golang.org/x/net/proxy"
+)
+
+func TestRoundTrip(t *testing.T) {
+	small := []byte("hello")
+	large := randomBytes(300 * 1024)
+
+	tests := []struct {
+		name   string
+		send   []byte
+		target func(c net.Conn) // serve the tunnel as the target, the conn is closed after.
+		wrap   func(h http.Handler) http.Handler
+		want   []byte
+	}{
+		{
+			name:   "echo",
+			send:   small,
+			target: echo(len(small)),
+			want:   small,
+		},
+		{
+			name:   "echo in chunks",
+			send:   large,
+			target: echo(len(large)),
+			want:   large,
+		},
+		{
+			name:   "target closes right after writing",
+			target: func(c net.Conn) { _, _ = c.Write(large) },
+			want:   large,
+		},
+		{
+			name:   "target closes without writing",
+			target: func(c net.Conn) {},
+			want:   []byte{},
+		},
+		{
+			name:   "lost upload response",
+			send:   large,
+			target: echo(len(large)),
+			wrap:   dropFirst(http.MethodPost, "1"),
+			want:   large,
+		},
+		{
+			name:   "lost download response",
+			send:   small,
+			target: echo(len(small)),
+			wrap:   dropFirst(http.MethodGet, "1"),
+			want:   small,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dialTestServer(t, tt.target, tt.wrap)
+			defer c.Close()
+
+			errCh := make(chan error, 1)
+			go func() {
+				_, err := c.Write(tt.send)
+				errCh <- err
+			}()
+
+			got, err := ioutil.ReadAll(c)
+			if err != nil {
+				t.Fatalf("read error = %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("read %d bytes, want %d", len(got), len(tt.want))
+			}
+			if err := <-errCh; err != nil {
+				t.Errorf("write error = %v", err)
+			}
+		})
+	}
+}
+
+// dialTestServer dial a poll tunnel to a test server, the connections accepted by
+// the server are served by target, requests go through wrap when not nil.
+func dialTestServer(t *testing.T, target func(c net.Conn), wrap func(h http.Handler) http.Handler) net.Conn {
+	t.Helper()
+
+	s := &Server{PollTimeout: 100 * time.Millisecond}
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Serve(w, r, "alice", r.URL.Path, func(c net.Conn) {
+			defer c.Close()
+			target(c)
+		})
+	})
+	if wrap != nil {
+		h = wrap(h)
+	}
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL + "/target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.User = url.UserPassword("alice", "secret")
+	d := &Dialer{
+		Dialer:      &base.Dialer{URL: u, Forward: proxy.Direct, HaveAuth: true, Username: "alice", Password: "secret"},
+		PollTimeout: s.PollTimeout,
+	}
+
+	c, err := d.Dial("tcp", "target")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// echo return a target writing back n bytes read.
+func echo(n int) func(c net.Conn) {
+	return func(c net.Conn) {
+		_, _ = io.CopyN(c, c, int64(n))
+	}
+}
+
+// dropFirst return a wrapper which serves the first request of method with
+// sequence seq but replies 502, so the client retries after the response lost.
+func dropFirst(method, seq string) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		var once sync.Once
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			drop := false
+			if r.Method == method && r.Header.Get(HeaderSeq) == seq && r.Header.Get(HeaderSession) != sessionNew {
+				once.Do(func() { drop = true })
+			}
+			if !drop {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			// a dropped download should carry data, poll again while there is none.
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			for method == http.MethodGet && rec.Code == http.StatusNoContent {
+				rec = httptest.NewRecorder()
+				h.ServeHTTP(rec, r)
+			}
+			http.Error(w, "response lost", http.StatusBadGateway)
+		})
+	}
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(b)
+
+	return b
+}
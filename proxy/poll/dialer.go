@@ -0,0 +1,117 @@
+// Package poll implement proxy.Dialer(s) with split upload/download http requests,
+// for http proxies which buffer the whole request body.
+//
+// Upload data is sent as a series of short POST requests with sequence numbers,
+// download data is fetched with repeated long polling GET requests.
+package poll
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/wuhuizuo/tcpb/proxy/base"
+
+	"github.com/pkg/errors"
+)
+
+// Method is the pseudo http method name for choosing this tunnel.
+const Method = "POLL"
+
+// http headers of the tunnel protocol.
+const (
+	HeaderSession = "X-Tcpb-Session" // session id, "new" for opening.
+	HeaderSeq     = "X-Tcpb-Seq"     // sequence number of upload or download chunk.
+)
+
+// DefaultPollTimeout is the default max duration the server holds a download request.
+const DefaultPollTimeout = 25 * time.Second
+
+const (
+	sessionNew       = "new"
+	maxChunkLen      = 64 * 1024
+	maxBufferedLen   = 1024 * 1024
+	maxPendingChunks = 64
+	maxRetries       = 3
+	retryDelay       = 200 * time.Millisecond // doubled for every failure.
+	maxRetryDelay    = 2 * time.Second
+)
+
+var (
+	errSeqMismatch   = errors.New("sequence number mismatch")
+	errTooManyChunks = errors.New("too many out of order chunks")
+)
+
+// Dialer implement proxy.Dialer for http/https with split upload/download requests.
+type Dialer struct {
+	*base.Dialer
+
+	// PollTimeout should be same as the server, the client waits a little longer for download response.
+	PollTimeout time.Duration
+}
+
+// Dial connects to the given address via the server.
+func (d *Dialer) Dial(network, _ string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, errors.New("only tcp supported")
+	}
+
+	pollTimeout := d.PollTimeout
+	if pollTimeout <= 0 {
+		pollTimeout = DefaultPollTimeout
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial:                d.Forward.Dial,
+			TLSClientConfig:     d.TLSClientConfig,
+			TLSHandshakeTimeout: d.DialTimeout,
+			MaxIdleConnsPerHost: 2,
+		},
+		Timeout: pollTimeout + 10*time.Second,
+	}
+
+	req, err := d.newRequest(http.MethodPost, sessionNew, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("non-OK status: %v", resp.Status)
+	}
+	id := resp.Header.Get(HeaderSession)
+	if id == "" {
+		return nil, errors.New("no session id in response")
+	}
+
+	return newClientConn(d, client, id), nil
+}
+
+func (d *Dialer) newRequest(method, session string, body []byte) (*http.Request, error) {
+	u := *d.URL
+	u.User = nil
+
+	req, err := http.NewRequest(method, u.String(), bytesReader(body))
+	if err != nil {
+		return nil, err
+	}
+	d.FillHeaderToReq(req, "")
+	req.Header.Set(HeaderSession, session)
+
+	return req, nil
+}
+
+func bytesReader(b []byte) io.Reader {
+	if b == nil {
+		return nil
+	}
+
+	return bytes.NewReader(b)
+}
@@ -0,0 +1,411 @@
+package poll
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wuhuizuo/tcpb/logging"
+	"github.com/wuhuizuo/tcpb/proxy/post"
+)
+
+// Server serve split upload/download tunnels, every session is reassembled into a net.Conn.
+type Server struct {
+	// PollTimeout is the max duration for holding a download request without data.
+	PollTimeout time.Duration
+
+	// Logger for session events, logging.Default() when nil.
+	Logger logging.Logger
+
+	mu       sync.Mutex
+	sessions map[string]*serverConn
+	janitor  sync.Once
+}
+
+// IsPollRequest report whether r is a request for split upload/download tunnel.
+func IsPollRequest(r *http.Request) bool {
+	return r.Header.Get(HeaderSession) != ""
+}
+
+// IsOpenRequest report whether r is a request opening a new split upload/download session.
+func IsOpenRequest(r *http.Request) bool {
+	return r.Header.Get(HeaderSession) == sessionNew
+}
+
+// Serve handle a tunnel request of the authenticated user to target, accept is
+// called in a new goroutine with the reassembled connection when a new session
+// opened. Requests of a session should come from the user and target opening it.
+func (s *Server) Serve(w http.ResponseWriter, r *http.Request, user, target string, accept func(net.Conn)) {
+	id := r.Header.Get(HeaderSession)
+	if id == sessionNew {
+		if r.Method != http.MethodPost {
+			http.Error(w, "session should be opened with POST", http.StatusMethodNotAllowed)
+			return
+		}
+
+		c, err := s.open(r, user, target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(HeaderSession, c.id)
+		w.WriteHeader(http.StatusOK)
+		go accept(c)
+		return
+	}
+
+	c := s.session(id)
+	if c == nil || c.user != user || c.target != target {
+		// not telling the sessions of others apart from missing ones.
+		http.Error(w, "session not found", http.StatusGone)
+		return
+	}
+	c.touch()
+
+	switch r.Method {
+	case http.MethodPost:
+		s.upload(c, w, r)
+	case http.MethodGet:
+		s.download(c, w, r)
+	case http.MethodDelete:
+		_ = c.Close()
+		s.remove(c.id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) open(r *http.Request, user, target string) (*serverConn, error) {
+	idBytes := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, idBytes); err != nil {
+		return nil, err
+	}
+
+	var local net.Addr = post.StreamAddr{Net: "poll"}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		local = addr
+	}
+
+	c := newServerConn(hex.EncodeToString(idBytes), local, post.StreamAddr{Net: "poll", Addr: r.RemoteAddr})
+	c.user, c.target = user, target
+
+	s.mu.Lock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*serverConn)
+	}
+	s.sessions[c.id] = c
+	s.mu.Unlock()
+
+	s.janitor.Do(func() { go s.expireLoop() })
+
+	return c, nil
+}
+
+func (s *Server) session(id string) *serverConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sessions[id]
+}
+
+func (s *Server) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, id)
+}
+
+func (s *Server) upload(c *serverConn, w http.ResponseWriter, r *http.Request) {
+	seq, err := strconv.ParseUint(r.Header.Get(HeaderSeq), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid sequence number", http.StatusBadRequest)
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxChunkLen+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxChunkLen {
+		http.Error(w, "chunk too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err := c.deliver(seq, data); err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) download(c *serverConn, w http.ResponseWriter, r *http.Request) {
+	seq, err := strconv.ParseUint(r.Header.Get(HeaderSeq), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid sequence number", http.StatusBadRequest)
+		return
+	}
+
+	// a closed session is kept until its data is downloaded, the client sees EOF then.
+	data, err := c.poll(seq, s.pollTimeout(), r.Context().Done())
+	if err == io.EOF {
+		s.remove(c.id)
+	}
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusGone)
+	case data == nil:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set(HeaderSeq, strconv.FormatUint(seq, 10))
+		_, _ = w.Write(data)
+	}
+}
+
+func (s *Server) pollTimeout() time.Duration {
+	if s.PollTimeout > 0 {
+		return s.PollTimeout
+	}
+
+	return DefaultPollTimeout
+}
+
+// expireLoop close and remove sessions which client has gone away, closed
+// sessions not downloaded to the end are removed too.
+func (s *Server) expireLoop() {
+	ticker := time.NewTicker(s.pollTimeout())
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var expired []*serverConn
+
+		s.mu.Lock()
+		for _, c := range s.sessions {
+			if c.idle() > 3*s.pollTimeout() {
+				expired = append(expired, c)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, c := range expired {
+			logging.Or(s.Logger).Log(logging.LevelWarn, "poll session expired", "session", c.id, "remote", c.remote)
+			_ = c.Close()
+			s.remove(c.id)
+		}
+	}
+}
+
+// serverConn reassemble uploaded chunks and queue data for download requests.
+type serverConn struct {
+	id     string
+	user   string // authenticated user opening the session.
+	target string
+	local  net.Addr
+	remote net.Addr
+
+	upR  *io.PipeReader
+	upW  *io.PipeWriter
+	upMu sync.Mutex // keep uploaded chunks written in order.
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	upSeq    uint64            // next upload sequence to deliver.
+	upQueue  map[uint64][]byte // out of order upload chunks.
+	down     bytes.Buffer      // data waiting for download.
+	downSeq  uint64            // sequence of the last download chunk.
+	downLast []byte            // last download chunk, kept for retry.
+	lastSeen time.Time
+	closed   bool
+}
+
+func newServerConn(id string, local, remote net.Addr) *serverConn {
+	c := &serverConn{
+		id:       id,
+		local:    local,
+		remote:   remote,
+		upQueue:  make(map[uint64][]byte),
+		lastSeen: time.Now(),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.upR, c.upW = io.Pipe()
+
+	return c
+}
+
+// deliver write uploaded chunks to reader in sequence order.
+func (c *serverConn) deliver(seq uint64, data []byte) error {
+	c.upMu.Lock()
+	defer c.upMu.Unlock()
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return io.ErrClosedPipe
+	}
+	if seq < c.upSeq {
+		// duplicated chunk from retry.
+		c.mu.Unlock()
+		return nil
+	}
+	if len(c.upQueue) >= maxPendingChunks {
+		c.mu.Unlock()
+		return errTooManyChunks
+	}
+	c.upQueue[seq] = data
+
+	var ordered [][]byte
+	for {
+		chunk, ok := c.upQueue[c.upSeq]
+		if !ok {
+			break
+		}
+		delete(c.upQueue, c.upSeq)
+		c.upSeq++
+		ordered = append(ordered, chunk)
+	}
+	c.mu.Unlock()
+
+	for _, chunk := range ordered {
+		if _, err := c.upW.Write(chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// poll wait data for download chunk seq, a nil chunk is returned when timeout.
+func (c *serverConn) poll(seq uint64, timeout time.Duration, cancel <-chan struct{}) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// retry for the last chunk which response lost.
+	if seq == c.downSeq && c.downLast != nil {
+		return c.downLast, nil
+	}
+	if seq != c.downSeq+1 {
+		return nil, errSeqMismatch
+	}
+
+	// wake up waiting when timeout or request canceled.
+	deadline := time.Now().Add(timeout)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case <-cancel:
+		case <-timer.C:
+		case <-stop:
+			return
+		}
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	}()
+
+	for c.down.Len() == 0 && !c.closed && time.Now().Before(deadline) {
+		select {
+		case <-cancel:
+			return nil, nil
+		default:
+		}
+		c.cond.Wait()
+	}
+
+	if c.down.Len() == 0 {
+		if c.closed {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+
+	n := c.down.Len()
+	if n > maxChunkLen {
+		n = maxChunkLen
+	}
+	c.downLast = append([]byte(nil), c.down.Next(n)...)
+	c.downSeq = seq
+	c.cond.Broadcast()
+
+	return c.downLast, nil
+}
+
+func (c *serverConn) touch() {
+	c.mu.Lock()
+	c.lastSeen = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *serverConn) idle() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return time.Since(c.lastSeen)
+}
+
+// Read implement net.Conn.
+func (c *serverConn) Read(b []byte) (int, error) {
+	return c.upR.Read(b)
+}
+
+// Write implement net.Conn, it blocks when too much data waiting for download.
+func (c *serverConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.down.Len() >= maxBufferedLen && !c.closed {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	c.down.Write(b)
+	c.cond.Broadcast()
+
+	return len(b), nil
+}
+
+// Close implement net.Conn, data waiting for download is still served.
+func (c *serverConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	_ = c.upW.Close()
+
+	return nil
+}
+
+// LocalAddr implement net.Conn.
+func (c *serverConn) LocalAddr() net.Addr { return c.local }
+
+// RemoteAddr implement net.Conn.
+func (c *serverConn) RemoteAddr() net.Addr { return c.remote }
+
+// SetDeadline implement net.Conn, it does nothing.
+func (c *serverConn) SetDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline implement net.Conn, it does nothing.
+func (c *serverConn) SetReadDeadline(t time.Time) error { return nil }
+
+// SetWriteDeadline implement net.Conn, it does nothing.
+func (c *serverConn) SetWriteDeadline(t time.Time) error { return nil }
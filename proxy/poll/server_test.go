@@ -0,0 +1,282 @@
+package poll
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wuhuizuo/tcpb/proxy/post"
+)
+
+type chunk struct {
+	seq  uint64
+	data string
+}
+
+func TestServerConnDeliver(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunks  []chunk
+		want    string
+		wantErr error // error of the last chunk.
+	}{
+		{
+			name:   "in order",
+			chunks: []chunk{{0, "a"}, {1, "b"}, {2, "c"}},
+			want:   "abc",
+		},
+		{
+			name:   "out of order",
+			chunks: []chunk{{2, "c"}, {0, "a"}, {1, "b"}},
+			want:   "abc",
+		},
+		{
+			name:   "retried chunk",
+			chunks: []chunk{{0, "a"}, {0, "a"}, {1, "b"}, {0, "a"}},
+			want:   "ab",
+		},
+		{
+			name:   "gap",
+			chunks: []chunk{{0, "a"}, {2, "c"}},
+			want:   "a",
+		},
+		{
+			name:    "too many out of order chunks",
+			chunks:  append(pendingChunks(maxPendingChunks), chunk{maxPendingChunks + 1, "x"}),
+			want:    "",
+			wantErr: errTooManyChunks,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestServerConn()
+			read := make(chan string, 1)
+			go func() {
+				data, _ := ioutil.ReadAll(c)
+				read <- string(data)
+			}()
+
+			var err error
+			for _, ch := range tt.chunks {
+				err = c.deliver(ch.seq, []byte(ch.data))
+			}
+			if err != tt.wantErr {
+				t.Errorf("deliver() error = %v, want %v", err, tt.wantErr)
+			}
+
+			_ = c.Close()
+			if got := <-read; got != tt.want {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+			if err := c.deliver(100, []byte("late")); err != io.ErrClosedPipe {
+				t.Errorf("deliver() after close error = %v, want %v", err, io.ErrClosedPipe)
+			}
+		})
+	}
+}
+
+func pendingChunks(n int) []chunk {
+	chunks := make([]chunk, 0, n)
+	for i := 1; i <= n; i++ {
+		chunks = append(chunks, chunk{uint64(i), "x"})
+	}
+
+	return chunks
+}
+
+func TestServerConnPoll(t *testing.T) {
+	big := strings.Repeat("x", maxChunkLen+10)
+
+	type step struct {
+		seq     uint64
+		want    string // empty for no data.
+		wantErr error
+	}
+	tests := []struct {
+		name  string
+		data  string
+		close bool
+		steps []step
+	}{
+		{
+			name:  "sequence",
+			data:  "abc",
+			steps: []step{{seq: 1, want: "abc"}, {seq: 2}},
+		},
+		{
+			name:  "retry of lost response",
+			data:  "abc",
+			steps: []step{{seq: 1, want: "abc"}, {seq: 1, want: "abc"}, {seq: 2}},
+		},
+		{
+			name:  "sequence mismatch",
+			data:  "abc",
+			steps: []step{{seq: 2, wantErr: errSeqMismatch}, {seq: 1, want: "abc"}, {seq: 3, wantErr: errSeqMismatch}},
+		},
+		{
+			name:  "split into chunks",
+			data:  big,
+			steps: []step{{seq: 1, want: big[:maxChunkLen]}, {seq: 2, want: big[maxChunkLen:]}},
+		},
+		{
+			name:  "closed after writing",
+			data:  big,
+			close: true,
+			steps: []step{
+				{seq: 1, want: big[:maxChunkLen]},
+				{seq: 2, want: big[maxChunkLen:]},
+				{seq: 2, want: big[maxChunkLen:]},
+				{seq: 3, wantErr: io.EOF},
+				{seq: 3, wantErr: io.EOF},
+			},
+		},
+		{
+			name:  "closed without data",
+			close: true,
+			steps: []step{{seq: 1, wantErr: io.EOF}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestServerConn()
+			if tt.data != "" {
+				if _, err := c.Write([]byte(tt.data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.close {
+				_ = c.Close()
+			}
+
+			for i, s := range tt.steps {
+				data, err := c.poll(s.seq, 10*time.Millisecond, nil)
+				if err != s.wantErr {
+					t.Fatalf("step %d: poll(%d) error = %v, want %v", i, s.seq, err, s.wantErr)
+				}
+				if string(data) != s.want {
+					t.Fatalf("step %d: poll(%d) = %d bytes, want %d", i, s.seq, len(data), len(s.want))
+				}
+			}
+		})
+	}
+}
+
+func TestServerConnWriteAfterClose(t *testing.T) {
+	c := newTestServerConn()
+	_ = c.Close()
+
+	if _, err := c.Write([]byte("a")); err != io.ErrClosedPipe {
+		t.Errorf("Write() error = %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+func TestServerSession(t *testing.T) {
+	conns := make(chan net.Conn, 1)
+	s := &Server{PollTimeout: 50 * time.Millisecond}
+	handler := func(user, target string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.Serve(w, r, user, target, func(c net.Conn) { conns <- c })
+		})
+	}
+
+	do := func(h http.Handler, method, id string, seq uint64, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/target", strings.NewReader(body))
+		req.Header.Set(HeaderSession, id)
+		req.Header.Set(HeaderSeq, strconv.FormatUint(seq, 10))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	alice := handler("alice", "target")
+	rec := do(alice, http.MethodPost, sessionNew, 0, "")
+	id := rec.Header().Get(HeaderSession)
+	if rec.Code != http.StatusOK || id == "" {
+		t.Fatalf("open: status %d, session %q", rec.Code, id)
+	}
+	c := <-conns
+	read := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 4)
+		_, _ = io.ReadFull(c, buf)
+		read <- string(buf)
+	}()
+
+	tests := []struct {
+		name     string
+		handler  http.Handler
+		method   string
+		seq      uint64
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{name: "other user", handler: handler("bob", "target"), method: http.MethodGet, seq: 1, wantCode: http.StatusGone},
+		{name: "other target", handler: handler("alice", "other"), method: http.MethodPost, body: "x", wantCode: http.StatusGone},
+		{name: "upload", handler: alice, method: http.MethodPost, seq: 0, body: "ping", wantCode: http.StatusNoContent},
+		{name: "no data", handler: alice, method: http.MethodGet, seq: 1, wantCode: http.StatusNoContent},
+		{name: "download after target closed", handler: alice, method: http.MethodGet, seq: 1, wantCode: http.StatusOK, wantBody: "pong"},
+		{name: "retry download after target closed", handler: alice, method: http.MethodGet, seq: 1, wantCode: http.StatusOK, wantBody: "pong"},
+		{name: "eof", handler: alice, method: http.MethodGet, seq: 2, wantCode: http.StatusGone, wantBody: "EOF\n"},
+		{name: "removed after eof", handler: alice, method: http.MethodGet, seq: 2, wantCode: http.StatusGone, wantBody: "session not found\n"},
+	}
+
+	for _, tt := range tests {
+		if tt.name == "download after target closed" {
+			if got := <-read; got != "ping" {
+				t.Fatalf("target read %q, want %q", got, "ping")
+			}
+			_, _ = c.Write([]byte("pong"))
+			_ = c.Close()
+		}
+
+		rec := do(tt.handler, tt.method, id, tt.seq, tt.body)
+		if rec.Code != tt.wantCode {
+			t.Fatalf("%s: status %d %q, want %d", tt.name, rec.Code, rec.Body.String(), tt.wantCode)
+		}
+		if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+			t.Fatalf("%s: body %q, want %q", tt.name, rec.Body.String(), tt.wantBody)
+		}
+	}
+}
+
+func TestServerSessionDelete(t *testing.T) {
+	conns := make(chan net.Conn, 1)
+	s := &Server{}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Serve(w, r, "", "target", func(c net.Conn) { conns <- c })
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/target", nil)
+	req.Header.Set(HeaderSession, sessionNew)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	id := rec.Header().Get(HeaderSession)
+	c := <-conns
+
+	req = httptest.NewRequest(http.MethodDelete, "/target", nil)
+	req.Header.Set(HeaderSession, id)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d", rec.Code)
+	}
+	if s.session(id) != nil {
+		t.Errorf("session %s is kept after deleted", id)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("target read error = %v, want %v", err, io.EOF)
+	}
+}
+
+func newTestServerConn() *serverConn {
+	return newServerConn("test", post.StreamAddr{Net: "poll"}, post.StreamAddr{Net: "poll", Addr: "client"})
+}
@@ -0,0 +1,125 @@
+package post
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/wuhuizuo/tcpb/proxy/base"
+	"github.com/wuhuizuo/tcpb/proxy/internal"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+)
+
+// shared http/2 transports, keyed by the server and the dialing config.
+var h2Transports internal.H2Transports
+
+// H2Dialer implement proxy.Dialer for http/https with post method,
+// every tunnel is a bidirectional stream on a shared HTTP/2 connection:
+// request body for upstream and response body for downstream.
+type H2Dialer struct {
+	*base.Dialer
+}
+
+// Dial connects to the given address via the server.
+func (d *H2Dialer) Dial(network, _ string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, errors.New("only tcp supported")
+	}
+
+	u := *d.URL
+	u.User = nil
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, u.String(), pr)
+	if err != nil {
+		return nil, err
+	}
+	d.FillHeaderToReq(req, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if d.DialTimeout > 0 {
+		timer := time.AfterFunc(d.DialTimeout, cancel)
+		defer timer.Stop()
+	}
+
+	resp, err := d.transport().RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		_ = pw.Close()
+		if ctx.Err() != nil {
+			err = errors.Errorf("no connection to %q after %v", d.URL, d.DialTimeout)
+			return nil, internal.ErrorConnectionTimeout(err)
+		}
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		cancel()
+		_ = pw.Close()
+		_ = resp.Body.Close()
+		return nil, errors.Errorf("non-OK status: %v", resp.Status)
+	}
+
+	remote := StreamAddr{Net: "h2", Addr: d.ProxyAddr()}
+	return NewStreamConn(NewCancelBody(resp.Body, cancel), pw, StreamAddr{Net: "h2"}, remote), nil
+}
+
+// transport return the http/2 transport shared by dialers to the proxy server
+// with the same forward dialer, tls config and timeout.
+func (d *H2Dialer) transport() *http2.Transport {
+	key, shared := internal.NewH2Key(d.URL.Scheme+"://"+d.ProxyAddr(), d.Forward, d.TLSClientConfig, d.DialTimeout)
+
+	return h2Transports.Get(key, shared, func() *http2.Transport {
+		return &http2.Transport{
+			AllowHTTP: d.URL.Scheme == "http",
+			DialTLS:   d.dialTLS,
+		}
+	})
+}
+
+// dialTLS dial the proxy server with h2 protocol, h2c with prior knowledge for http scheme.
+func (d *H2Dialer) dialTLS(network, _ string, _ *tls.Config) (net.Conn, error) {
+	nc, err := d.Forward.Dial(network, d.ProxyAddr())
+	if err != nil {
+		return nil, err
+	}
+	if d.URL.Scheme != "https" {
+		return nc, nil
+	}
+
+	cfg := d.TLSClientConfig.Clone()
+	cfg.NextProtos = []string{http2.NextProtoTLS}
+	tc := tls.Client(nc, cfg)
+	if err := tc.Handshake(); err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+	if p := tc.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+		_ = tc.Close()
+		return nil, errors.Errorf("http2: unexpected ALPN protocol %q; want %q", p, http2.NextProtoTLS)
+	}
+
+	return tc, nil
+}
+
+// NewCancelBody return body calling cancel to release the stream context after closed.
+func NewCancelBody(body io.ReadCloser, cancel context.CancelFunc) io.ReadCloser {
+	return &cancelBody{body, cancel}
+}
+
+// cancelBody release the stream context after response body closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close implement io.Closer.
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
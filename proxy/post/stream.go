@@ -0,0 +1,102 @@
+package post
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// NewStreamConn return a net.Conn implement for a pair of http body streams,
+// reading from r and writing to w.
+func NewStreamConn(r io.ReadCloser, w io.WriteCloser, local, remote net.Addr) net.Conn {
+	return &streamConn{r: r, w: w, local: local, remote: remote}
+}
+
+// NewFlushWriter return a io.WriteCloser which flush the http response after every write.
+func NewFlushWriter(w http.ResponseWriter) io.WriteCloser {
+	f, _ := w.(http.Flusher)
+	return flushWriter{w, f}
+}
+
+// StreamAddr is a net.Addr for http stream endpoints.
+type StreamAddr struct {
+	Net  string
+	Addr string
+}
+
+// Network implement net.Addr.
+func (a StreamAddr) Network() string { return a.Net }
+
+// String implement net.Addr.
+func (a StreamAddr) String() string { return a.Addr }
+
+// streamConn wrapper http request/response body streams as net.Conn.
+type streamConn struct {
+	r      io.ReadCloser
+	w      io.WriteCloser
+	local  net.Addr
+	remote net.Addr
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Read implement net.Conn.
+func (s *streamConn) Read(b []byte) (n int, err error) {
+	return s.r.Read(b)
+}
+
+// Write implement net.Conn.
+func (s *streamConn) Write(b []byte) (n int, err error) {
+	return s.w.Write(b)
+}
+
+// Close implement net.Conn.
+func (s *streamConn) Close() error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.w.Close()
+		if err := s.r.Close(); s.closeErr == nil {
+			s.closeErr = err
+		}
+	})
+
+	return s.closeErr
+}
+
+// LocalAddr implement net.Conn.
+func (s *streamConn) LocalAddr() net.Addr { return s.local }
+
+// RemoteAddr implement net.Conn.
+func (s *streamConn) RemoteAddr() net.Addr { return s.remote }
+
+// SetDeadline implement net.Conn, http body streams have no deadline, it does nothing.
+func (s *streamConn) SetDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline implement net.Conn, it does nothing.
+func (s *streamConn) SetReadDeadline(t time.Time) error { return nil }
+
+// SetWriteDeadline implement net.Conn, it does nothing.
+func (s *streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// flushWriter flush data to http client immediately.
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+// Write implement io.Writer.
+func (fw flushWriter) Write(b []byte) (n int, err error) {
+	n, err = fw.w.Write(b)
+	if fw.f != nil {
+		fw.f.Flush()
+	}
+
+	return n, err
+}
+
+// Close implement io.Closer, the response stream ends when handler returned.
+func (fw flushWriter) Close() error {
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/wuhuizuo/tcpb/proxy/base"
 	"github.com/wuhuizuo/tcpb/proxy/connect"
 	"github.com/wuhuizuo/tcpb/proxy/internal"
+	"github.com/wuhuizuo/tcpb/proxy/poll"
 	"github.com/wuhuizuo/tcpb/proxy/post"
 	"github.com/wuhuizuo/tcpb/proxy/websocket"
 
@@ -54,23 +55,16 @@ func FromURLBy(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
 }
 
 // FromURLWithConfig is like New, but allows control over various options.
+// cfg may be shared by dialers of several urls, the tls server name is the
+// host of u when it is not set in cfg.
 func FromURLWithConfig(u *url.URL, forward proxy.Dialer, cfg *Config) (proxy.Dialer, error) {
-	var baseCfg BaseConfig
 	if cfg == nil {
 		cfg = DefaultConfig(u)
 	}
 
-	// set tls
-	if cfg.Base.TLSClientConfig != nil {
-		switch u.Scheme {
-		case SchemeHTTPS, SchemeWebsocketSec:
-			cfg.Base.TLSClientConfig = &tls.Config{
-				ServerName:         u.Hostname(),
-				InsecureSkipVerify: true,
-			}
-		default:
-			// nothing
-		}
+	baseCfg := cfg.Base
+	if baseCfg.TLSClientConfig != nil {
+		baseCfg.TLSClientConfig = baseCfg.TLSClientConfig.Clone()
 	}
 
 	baseDialer, err := baseDialerWithConfig(u, forward, baseCfg)
@@ -83,13 +77,21 @@ func FromURLWithConfig(u *url.URL, forward proxy.Dialer, cfg *Config) (proxy.Dia
 		return &websocket.Dialer{
 			Dialer:        baseDialer,
 			HeartInterval: cfg.WSHeartInterval,
+			Compression:   cfg.WSCompression,
+			HTTP2:         cfg.HTTP2,
+			Logger:        cfg.Logger,
 		}, nil
 	case SchemeHTTP, SchemeHTTPS:
 		switch cfg.HTTPMethod {
 		case http.MethodConnect:
 			return &connect.Dialer{Dialer: baseDialer}, nil
 		case http.MethodPost:
+			if cfg.HTTP2 {
+				return &post.H2Dialer{Dialer: baseDialer}, nil
+			}
 			return &post.Dialer{Dialer: baseDialer}, nil
+		case poll.Method:
+			return &poll.Dialer{Dialer: baseDialer}, nil
 		default:
 			return nil, errors.Errorf("unsupported method for proxy: %s", cfg.HTTPMethod)
 		}
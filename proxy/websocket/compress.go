@@ -0,0 +1,135 @@
+package websocket
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// compression level range of permessage-deflate, -2 is huffman only.
+const (
+	MinCompressionLevel     = -2
+	MaxCompressionLevel     = 9
+	DefaultCompressionLevel = 1
+)
+
+const extensionDeflate = "permessage-deflate"
+
+// Compression configure permessage-deflate(RFC 7692) of websocket connections, it
+// is offered by dialers and accepted by upgraders when Enabled, and takes effect
+// only when negotiated by both peers.
+type Compression struct {
+	Enabled bool
+	Level   int // flate level from MinCompressionLevel to MaxCompressionLevel, 0 for DefaultCompressionLevel.
+	MinSize int // messages smaller than MinSize bytes are sent uncompressed.
+}
+
+// Validate check the level and min size.
+func (c Compression) Validate() error {
+	if c.Level < MinCompressionLevel || c.Level > MaxCompressionLevel {
+		return errors.Errorf("compression level %d out of range [%d, %d]", c.Level, MinCompressionLevel, MaxCompressionLevel)
+	}
+	if c.MinSize < 0 {
+		return errors.Errorf("negative compression min size %d", c.MinSize)
+	}
+
+	return nil
+}
+
+// Setup set the compression level of ws when c is enabled.
+func (c Compression) Setup(ws *websocket.Conn) error {
+	if !c.Enabled {
+		return nil
+	}
+
+	level := c.Level
+	if level == 0 {
+		level = DefaultCompressionLevel
+	}
+
+	return errors.WithStack(ws.SetCompressionLevel(level))
+}
+
+// prepare choose whether the next message of n bytes written to ws is compressed,
+// it should be called with the writing serialized.
+func (c Compression) prepare(ws *websocket.Conn, n int) {
+	if c.Enabled {
+		ws.EnableWriteCompression(n >= c.MinSize)
+	}
+}
+
+// Negotiated report whether permessage-deflate is in the extensions of handshake
+// header h: offered for requests and accepted for responses.
+func Negotiated(h http.Header) bool {
+	for _, v := range h.Values("Sec-Websocket-Extensions") {
+		for _, ext := range strings.Split(v, ",") {
+			name := strings.TrimSpace(strings.SplitN(ext, ";", 2)[0])
+			if strings.EqualFold(name, extensionDeflate) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// WireConn count the bytes read and written on the connection under websocket
+// framing, compared to the payload for compression ratio.
+type WireConn struct {
+	net.Conn
+	n int64 // atomic.
+}
+
+// NewWireConn return the counting wrapper of c.
+func NewWireConn(c net.Conn) *WireConn {
+	return &WireConn{Conn: c}
+}
+
+// Read implement net.Conn.
+func (c *WireConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// Write implement net.Conn.
+func (c *WireConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// Bytes return the bytes read and written.
+func (c *WireConn) Bytes() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// MeterWire return w whose hijacked connection is a *WireConn, then the upgraded
+// websocket connection report it by UnderlyingConn.
+func MeterWire(w http.ResponseWriter) http.ResponseWriter {
+	if _, ok := w.(http.Hijacker); !ok {
+		return w
+	}
+
+	return wireHijacker{w}
+}
+
+type wireHijacker struct {
+	http.ResponseWriter
+}
+
+func (w wireHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c, brw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil || brw.Reader.Buffered() > 0 {
+		// buffered data can not be counted, the upgrader reject it anyway.
+		return c, brw, err
+	}
+
+	wc := NewWireConn(c)
+	return wc, bufio.NewReadWriter(bufio.NewReader(wc), bufio.NewWriter(wc)), nil
+}
@@ -1,54 +1,98 @@
 package websocket
 
 import (
-	"log"
+	"io"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/wuhuizuo/tcpb/logging"
+
 	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
 )
 
+var errAlreadyClosed = errors.New("websocket connection already closed")
+
 // NewWSConn return a new.Conn implement for *github.com/gorilla/websocket.Conn.
 func NewWSConn(ws *websocket.Conn, wsHeartInterval time.Duration) net.Conn {
+	return NewWSConnWithLogger(ws, wsHeartInterval, nil)
+}
+
+// NewWSConnWithLogger return a net.Conn like NewWSConn, logger can be nil for logging.Default().
+func NewWSConnWithLogger(ws *websocket.Conn, wsHeartInterval time.Duration, logger logging.Logger) net.Conn {
+	return NewCompressedWSConn(ws, Compression{}, wsHeartInterval, logger)
+}
+
+// NewCompressedWSConn return a net.Conn like NewWSConn, every Write is one message
+// compressed by c when permessage-deflate is negotiated, c.Setup should be done before.
+func NewCompressedWSConn(ws *websocket.Conn, c Compression, wsHeartInterval time.Duration, logger logging.Logger) net.Conn {
 	if wsHeartInterval == 0 {
-		return wsConn{ws, nil, nil}
+		return &wsConn{Conn: ws, version: Version(ws), compression: c, closeOnce: new(sync.Once)}
 	}
 
 	writeMux := new(sync.Mutex)
-	heartStop := wsHeartHandler(ws, wsHeartInterval, writeMux)
+	heartStop := wsHeartHandler(ws, wsHeartInterval, writeMux, logger)
 
-	log.Println("[DEBUG] ", "NewWSConn wrapped ok.")
-	return wsConn{ws, writeMux, heartStop}
+	logging.Or(logger).Log(logging.LevelDebug, "websocket connection wrapped", "remote", ws.RemoteAddr())
+	return &wsConn{Conn: ws, version: Version(ws), compression: c, writeMux: writeMux, heartStop: heartStop, closeOnce: new(sync.Once)}
 }
 
 // wsConn wrap *github.com/gorilla/websocket.Conn with implement for net.Conn.
 type wsConn struct {
 	*websocket.Conn
-	writeMux  *sync.Mutex
-	heartStop chan<- bool
+	version     int // negotiated tcpb protocol version.
+	compression Compression
+	writeMux    *sync.Mutex
+	heartStop   chan<- bool
+	closeOnce   *sync.Once
+	reader      io.Reader // reader of the message partly read.
 }
 
-func (ws wsConn) Close() error {
-	if ws.heartStop != nil {
-		ws.heartStop <- true
-	}
+func (ws *wsConn) Close() error {
+	err := errAlreadyClosed
+	ws.closeOnce.Do(func() {
+		if ws.heartStop != nil {
+			ws.heartStop <- true
+		}
+
+		err = ws.Conn.Close()
+	})
 
-	return ws.Conn.Close()
+	return err
 }
 
-// Read implement net.Conn.
-func (ws wsConn) Read(b []byte) (n int, err error) {
-	_, r, err := ws.NextReader()
-	if err != nil {
-		return n, err
-	}
+// Read implement net.Conn, a message can be read with many calls, messages
+// without payload in the negotiated protocol version are skipped.
+func (ws *wsConn) Read(b []byte) (n int, err error) {
+	for {
+		if ws.reader == nil {
+			var messageType int
+			messageType, ws.reader, err = ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if !isPayload(ws.version, messageType) {
+				ws.reader = nil
+				continue
+			}
+		}
 
-	return r.Read(b)
+		n, err = ws.reader.Read(b)
+		if err != io.EOF {
+			return n, err
+		}
+
+		// message finished, continue with the next message when nothing read.
+		ws.reader = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
 }
 
 // Write implement net.Conn.
-func (ws wsConn) Write(b []byte) (n int, err error) {
+func (ws *wsConn) Write(b []byte) (n int, err error) {
 	if len(b) == 0 {
 		return 0, nil
 	}
@@ -58,6 +102,7 @@ func (ws wsConn) Write(b []byte) (n int, err error) {
 		defer ws.writeMux.Unlock()
 	}
 
+	ws.compression.prepare(ws.Conn, len(b))
 	w, err := ws.NextWriter(websocket.BinaryMessage)
 	if err != nil {
 		return 0, err
@@ -68,12 +113,12 @@ func (ws wsConn) Write(b []byte) (n int, err error) {
 }
 
 // SetDeadline implement net.Conn.
-func (ws wsConn) SetDeadline(t time.Time) error {
+func (ws *wsConn) SetDeadline(t time.Time) error {
 	return ws.Conn.UnderlyingConn().SetDeadline(t)
 }
 
 // wsHeartHandler send ping package timely to keep alive.
-func wsHeartHandler(wsCon *websocket.Conn, interval time.Duration, wsWriteMux *sync.Mutex) chan<- bool {
+func wsHeartHandler(wsCon *websocket.Conn, interval time.Duration, wsWriteMux *sync.Mutex, logger logging.Logger) chan<- bool {
 	if interval <= 0 {
 		return nil
 	}
@@ -100,7 +145,7 @@ func wsHeartHandler(wsCon *websocket.Conn, interval time.Duration, wsWriteMux *s
 					wsWriteMux.Unlock()
 				}
 			case <-stop:
-				log.Println("[INFO ] receive heart stop instruct")
+				logging.Or(logger).Log(logging.LevelDebug, "websocket heartbeat stopped", "remote", wsCon.RemoteAddr())
 				ticker.Stop()
 				return
 			}
@@ -0,0 +1,46 @@
+package websocket
+
+import (
+	"net"
+	"time"
+
+	"github.com/wuhuizuo/tcpb/logging"
+
+	"github.com/gorilla/websocket"
+)
+
+// NewDatagramConn return a net.Conn implement keeping message boundaries for
+// *github.com/gorilla/websocket.Conn: every Write sends one binary message and
+// every Read returns one whole message, the excess is discarded like udp when b is too small.
+func NewDatagramConn(ws *websocket.Conn, wsHeartInterval time.Duration) net.Conn {
+	return NewDatagramConnWithLogger(ws, wsHeartInterval, nil)
+}
+
+// NewDatagramConnWithLogger return a net.Conn like NewDatagramConn, logger can be nil for logging.Default().
+func NewDatagramConnWithLogger(ws *websocket.Conn, wsHeartInterval time.Duration, logger logging.Logger) net.Conn {
+	return NewCompressedDatagramConn(ws, Compression{}, wsHeartInterval, logger)
+}
+
+// NewCompressedDatagramConn return a net.Conn like NewDatagramConn, datagrams are
+// compressed by c when permessage-deflate is negotiated, c.Setup should be done before.
+func NewCompressedDatagramConn(ws *websocket.Conn, c Compression, wsHeartInterval time.Duration, logger logging.Logger) net.Conn {
+	return datagramConn{NewCompressedWSConn(ws, c, wsHeartInterval, logger).(*wsConn)}
+}
+
+// datagramConn wrap *github.com/gorilla/websocket.Conn with message boundaries.
+type datagramConn struct {
+	*wsConn
+}
+
+// Read implement net.Conn.
+func (d datagramConn) Read(b []byte) (n int, err error) {
+	for {
+		messageType, data, err := d.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		if messageType == websocket.BinaryMessage {
+			return copy(b, data), nil
+		}
+	}
+}
@@ -2,11 +2,11 @@ package websocket
 
 import (
 	"encoding/base64"
-	"log"
 	"net"
 	"net/http"
 	"time"
 
+	"github.com/wuhuizuo/tcpb/logging"
 	"github.com/wuhuizuo/tcpb/proxy/base"
 
 	"github.com/gorilla/websocket"
@@ -17,6 +17,16 @@ import (
 type Dialer struct {
 	*base.Dialer
 	HeartInterval time.Duration
+
+	// Compression offer permessage-deflate to the server when enabled.
+	Compression Compression
+
+	// HTTP2 bootstrap wss tunnels with HTTP/2 extended CONNECT(RFC 8441) first,
+	// fallback to HTTP/1.1 upgrade when the server does not support it.
+	HTTP2 bool
+
+	// Logger for the dialed connections, logging.Default() when nil.
+	Logger logging.Logger
 }
 
 // Dial connects to the single proxy peer via the server.
@@ -26,20 +36,43 @@ func (d *Dialer) Dial(network, _ string) (net.Conn, error) {
 	}
 
 	wsDialer := &websocket.Dialer{
-		HandshakeTimeout: d.DialTimeout,
-		NetDial:          d.Forward.Dial,
-		TLSClientConfig:  d.TLSClientConfig,
+		HandshakeTimeout:  d.DialTimeout,
+		NetDial:           d.Forward.Dial,
+		TLSClientConfig:   d.TLSClientConfig,
+		EnableCompression: d.Compression.Enabled,
+		Subprotocols:      Protocols,
 	}
 
-	log.Println("[DEBUG] ", "websocket proxy url: ", d.URL.String())
-	wsCon, _, err := wsDialer.Dial(d.URL.String(), d.newHeader())
+	logger := logging.Or(d.Logger)
+	logger.Log(logging.LevelDebug, "dialing websocket proxy", "url", d.URL)
+	wsCon, err := d.dial(wsDialer)
 	if err != nil {
 		return nil, errors.Wrapf(err, "dial ws %s failed", d.URL)
 	}
 
-	log.Println("[DEBUG] ", "proxy dialed ok.")
+	logger.Log(logging.LevelDebug, "websocket proxy dialed", "url", d.URL, "protocol", Version(wsCon))
+	if err := d.Compression.Setup(wsCon); err != nil {
+		wsCon.Close()
+		return nil, err
+	}
+
+	return NewCompressedWSConn(wsCon, d.Compression, d.HeartInterval, d.Logger), nil
+}
+
+func (d *Dialer) dial(wsDialer *websocket.Dialer) (*websocket.Conn, error) {
+	if d.HTTP2 {
+		wsCon, err := DialH2(wsDialer, d.Forward, d.URL.String(), d.newHeader())
+		if err == nil {
+			return wsCon, nil
+		}
+		if !errors.Is(err, ErrExtendedConnectUnsupported) {
+			return nil, err
+		}
+		logging.Or(d.Logger).Log(logging.LevelInfo, "fallback to http/1.1 upgrade", "url", d.URL, "err", err)
+	}
 
-	return NewWSConn(wsCon, d.HeartInterval), nil
+	wsCon, _, err := wsDialer.Dial(d.URL.String(), d.newHeader())
+	return wsCon, err
 }
 
 func (d *Dialer) newHeader() http.Header {
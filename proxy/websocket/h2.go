@@ -0,0 +1,381 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wuhuizuo/tcpb/proxy/internal"
+	"github.com/wuhuizuo/tcpb/proxy/post"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/proxy"
+)
+
+// ErrExtendedConnectUnsupported is returned when the websocket over HTTP/2 extended
+// CONNECT(RFC 8441) can not be used, caller should fallback to HTTP/1.1 upgrade.
+var ErrExtendedConnectUnsupported = errors.New("websocket over http/2 extended connect not supported")
+
+const (
+	websocketGUID   = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	headerEnd       = "\r\n\r\n"
+	protocolPseudo  = ":protocol"
+	protocolWS      = "websocket"
+	h2FailureExpiry = 5 * time.Minute
+
+	// errExtendedConnectNotSupported is the message of http2.Transport when the
+	// server does not advertise SETTINGS_ENABLE_CONNECT_PROTOCOL.
+	errExtendedConnectNotSupported = "extended connect not supported by peer"
+)
+
+// shared http/2 transports keyed by the server and the dialing config, and servers
+// recently found not supporting extended connect keyed by host.
+var (
+	h2Transports internal.H2Transports
+	h2Failures   sync.Map // host -> time.Time
+)
+
+// IsExtendedConnect report whether r is a websocket bootstrapping request with HTTP/2 extended CONNECT.
+func IsExtendedConnect(r *http.Request) bool {
+	return r.ProtoMajor == 2 && r.Method == http.MethodConnect && r.Header.Get(protocolPseudo) == protocolWS
+}
+
+// UpgradeH2 upgrades the HTTP/2 extended CONNECT stream to the websocket protocol,
+// the negotiated subprotocol and extensions are sent in the response headers.
+func UpgradeH2(upgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	if !IsExtendedConnect(r) {
+		http.Error(w, "not a websocket extended connect request", http.StatusBadRequest)
+		return nil, ErrExtendedConnectUnsupported
+	}
+
+	key := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	// compose a http/1.1 upgrade request for upgrader.
+	upgradeReq := new(http.Request)
+	*upgradeReq = *r
+	upgradeReq.Method = http.MethodGet
+	upgradeReq.Header = r.Header.Clone()
+	upgradeReq.Header.Del(protocolPseudo)
+	upgradeReq.Header.Set("Connection", "Upgrade")
+	upgradeReq.Header.Set("Upgrade", protocolWS)
+	upgradeReq.Header.Set("Sec-Websocket-Key", base64.StdEncoding.EncodeToString(key))
+
+	var local net.Addr = post.StreamAddr{Net: "h2"}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		local = addr
+	}
+	stream := post.NewStreamConn(r.Body, post.NewFlushWriter(w), local, post.StreamAddr{Net: "h2", Addr: r.RemoteAddr})
+
+	return upgrader.Upgrade(&h2Hijacker{w, &h2ServerConn{Conn: stream, w: w}}, upgradeReq, nil)
+}
+
+// DialH2 dial websocket over HTTP/2 extended CONNECT(RFC 8441) with the TLS config and
+// handshake timeout of wsDialer, the server is dialed with forward, nil for direct.
+// Tunnels to the same host with the same forward and options share one TLS connection.
+// It returns ErrExtendedConnectUnsupported when the server does not negotiate h2 by
+// ALPN or not advertise SETTINGS_ENABLE_CONNECT_PROTOCOL, other errors are returned as is.
+func DialH2(wsDialer *websocket.Dialer, forward proxy.Dialer, urlStr string, header http.Header) (*websocket.Conn, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if u.Scheme != "wss" {
+		return nil, errors.Wrapf(ErrExtendedConnectUnsupported, "scheme %s", u.Scheme)
+	}
+	if failedAt, ok := h2Failures.Load(u.Host); ok && time.Since(failedAt.(time.Time)) < h2FailureExpiry {
+		return nil, errors.Wrapf(ErrExtendedConnectUnsupported, "host %s", u.Host)
+	}
+
+	shim := &h2ClientConn{rt: h2Transport(wsDialer, forward, u), url: *u, timeout: wsDialer.HandshakeTimeout}
+	d := *wsDialer
+	d.Proxy = nil
+	d.NetDialContext = nil
+	d.NetDial = func(string, string) (net.Conn, error) { return shim, nil }
+
+	u.Scheme = "ws"
+	wsCon, _, err := d.Dial(u.String(), header)
+	if err != nil {
+		if errors.Is(shim.err, ErrExtendedConnectUnsupported) {
+			h2Failures.Store(u.Host, time.Now())
+			return nil, shim.err
+		}
+		return nil, err
+	}
+
+	return wsCon, nil
+}
+
+// h2Transport return the http/2 transport shared by tunnels to the websocket server
+// with the same forward dialer, tls config and handshake timeout.
+func h2Transport(wsDialer *websocket.Dialer, forward proxy.Dialer, u *url.URL) *http2.Transport {
+	key, shared := internal.NewH2Key("wss://"+u.Host, forward, wsDialer.TLSClientConfig, wsDialer.HandshakeTimeout)
+
+	return h2Transports.Get(key, shared, func() *http2.Transport {
+		return newH2Transport(wsDialer.TLSClientConfig, forward, u)
+	})
+}
+
+func newH2Transport(tlsClientConfig *tls.Config, forward proxy.Dialer, u *url.URL) *http2.Transport {
+	if forward == nil {
+		forward = proxy.Direct
+	}
+
+	tlsCfg := &tls.Config{}
+	if tlsClientConfig != nil {
+		tlsCfg = tlsClientConfig.Clone()
+	}
+	if tlsCfg.ServerName == "" {
+		tlsCfg.ServerName = u.Hostname()
+	}
+	tlsCfg.NextProtos = []string{http2.NextProtoTLS}
+
+	return &http2.Transport{
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			nc, err := forward.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			tc := tls.Client(nc, tlsCfg)
+			if err := tc.Handshake(); err != nil {
+				_ = nc.Close()
+				return nil, err
+			}
+			if p := tc.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+				_ = tc.Close()
+				return nil, errors.Wrapf(ErrExtendedConnectUnsupported, "unexpected ALPN protocol %q", p)
+			}
+
+			return tc, nil
+		},
+	}
+}
+
+// h2ClientConn translate the http/1.1 upgrade handshake from websocket.Dialer
+// into a HTTP/2 extended CONNECT request, then relay frames in the stream.
+type h2ClientConn struct {
+	rt      *http2.Transport
+	url     url.URL
+	timeout time.Duration
+
+	handshake bytes.Buffer
+	reader    io.Reader
+	stream    net.Conn
+	err       error
+}
+
+// Read implement net.Conn.
+func (c *h2ClientConn) Read(b []byte) (int, error) {
+	if c.reader == nil {
+		return 0, errors.New("websocket handshake not sent")
+	}
+
+	return c.reader.Read(b)
+}
+
+// Write implement net.Conn.
+func (c *h2ClientConn) Write(b []byte) (int, error) {
+	if c.stream != nil {
+		return c.stream.Write(b)
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	c.handshake.Write(b)
+	if !bytes.Contains(c.handshake.Bytes(), []byte(headerEnd)) {
+		return len(b), nil
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(&c.handshake))
+	if err == nil {
+		err = c.connect(req)
+	}
+	if err != nil {
+		c.err = err
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// connect send the extended CONNECT request and prepare the http/1.1 upgrade response.
+func (c *h2ClientConn) connect(upgradeReq *http.Request) error {
+	header := upgradeReq.Header.Clone()
+	for _, k := range []string{"Connection", "Upgrade", "Sec-Websocket-Key"} {
+		header.Del(k)
+	}
+	header.Set(protocolPseudo, protocolWS)
+
+	u := c.url
+	u.Scheme = "https"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if c.timeout > 0 {
+		timer := time.AfterFunc(c.timeout, cancel)
+		defer timer.Stop()
+	}
+
+	pr, pw := io.Pipe()
+	req := (&http.Request{
+		Method: http.MethodConnect,
+		URL:    &u,
+		Host:   upgradeReq.Host,
+		Header: header,
+		Body:   pr,
+	}).WithContext(ctx)
+
+	resp, err := c.rt.RoundTrip(req)
+	if err != nil {
+		cancel()
+		_ = pw.Close()
+		if strings.Contains(err.Error(), errExtendedConnectNotSupported) {
+			return errors.Wrap(ErrExtendedConnectUnsupported, err.Error())
+		}
+		return err
+	}
+	if resp.ProtoMajor != 2 {
+		cancel()
+		_ = pw.Close()
+		_ = resp.Body.Close()
+		return errors.Wrapf(ErrExtendedConnectUnsupported, "protocol %s", resp.Proto)
+	}
+
+	var handshakeResp bytes.Buffer
+	if resp.StatusCode != http.StatusOK {
+		cancel()
+		_ = pw.Close()
+		_ = resp.Body.Close()
+		handshakeResp.WriteString("HTTP/1.1 " + resp.Status + "\r\nContent-Length: 0\r\n\r\n")
+		c.reader = &handshakeResp
+		return nil
+	}
+
+	accept := sha1.Sum([]byte(upgradeReq.Header.Get("Sec-Websocket-Key") + websocketGUID))
+	handshakeResp.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	handshakeResp.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n")
+	for _, k := range []string{"Sec-Websocket-Protocol", "Sec-Websocket-Extensions"} {
+		if v := resp.Header.Get(k); v != "" {
+			handshakeResp.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	handshakeResp.WriteString("\r\n")
+
+	remote := post.StreamAddr{Net: "h2", Addr: u.Host}
+	c.stream = post.NewStreamConn(post.NewCancelBody(resp.Body, cancel), pw, post.StreamAddr{Net: "h2"}, remote)
+	c.reader = io.MultiReader(&handshakeResp, c.stream)
+
+	return nil
+}
+
+// Close implement net.Conn.
+func (c *h2ClientConn) Close() error {
+	if c.stream == nil {
+		return nil
+	}
+
+	return c.stream.Close()
+}
+
+// LocalAddr implement net.Conn.
+func (c *h2ClientConn) LocalAddr() net.Addr {
+	if c.stream == nil {
+		return post.StreamAddr{Net: "h2"}
+	}
+
+	return c.stream.LocalAddr()
+}
+
+// RemoteAddr implement net.Conn.
+func (c *h2ClientConn) RemoteAddr() net.Addr {
+	if c.stream == nil {
+		return post.StreamAddr{Net: "h2", Addr: c.url.Host}
+	}
+
+	return c.stream.RemoteAddr()
+}
+
+// SetDeadline implement net.Conn, it does nothing for http/2 stream.
+func (c *h2ClientConn) SetDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline implement net.Conn, it does nothing for http/2 stream.
+func (c *h2ClientConn) SetReadDeadline(t time.Time) error { return nil }
+
+// SetWriteDeadline implement net.Conn, it does nothing for http/2 stream.
+func (c *h2ClientConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// h2ServerConn translate the http/1.1 upgrade response from websocket.Upgrader
+// into the HTTP/2 response headers, then relay frames in the stream.
+type h2ServerConn struct {
+	net.Conn
+	w http.ResponseWriter
+
+	handshake bytes.Buffer
+	done      bool
+}
+
+// Write implement net.Conn.
+func (c *h2ServerConn) Write(b []byte) (int, error) {
+	if c.done {
+		return c.Conn.Write(b)
+	}
+
+	c.handshake.Write(b)
+	i := bytes.Index(c.handshake.Bytes(), []byte(headerEnd))
+	if i < 0 {
+		return len(b), nil
+	}
+
+	rest := c.handshake.Bytes()[i+len(headerEnd):]
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(c.handshake.Bytes()[:i+len(headerEnd)])), nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range []string{"Sec-Websocket-Protocol", "Sec-Websocket-Extensions"} {
+		if v := resp.Header.Get(k); v != "" {
+			c.w.Header().Set(k, v)
+		}
+	}
+	c.w.WriteHeader(http.StatusOK)
+	c.w.(http.Flusher).Flush()
+	c.done = true
+
+	if len(rest) > 0 {
+		if _, err := c.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// h2Hijacker let websocket.Upgrader take over the HTTP/2 stream.
+type h2Hijacker struct {
+	http.ResponseWriter
+	conn *h2ServerConn
+}
+
+// Hijack implement http.Hijacker.
+func (h *h2Hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if _, ok := h.ResponseWriter.(http.Flusher); !ok {
+		return nil, nil, errors.New("http response writer does not support flushing")
+	}
+
+	return h.conn, bufio.NewReadWriter(bufio.NewReader(h.conn), bufio.NewWriter(h.conn)), nil
+}
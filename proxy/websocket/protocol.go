@@ -0,0 +1,31 @@
+package websocket
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+// Subprotocols of tcpb tunnels negotiated by Sec-WebSocket-Protocol.
+const (
+	ProtocolV1 = "tcpb.v1" // every data message is payload, the same as legacy peers.
+	ProtocolV2 = "tcpb.v2" // binary messages are payload, text messages are reserved for control and skipped.
+)
+
+// Protocols is the subprotocols for dialers and upgraders, the highest version
+// first so upgraders pick the highest version offered by both peers.
+var Protocols = []string{ProtocolV2, ProtocolV1}
+
+var protocolVersions = map[string]int{
+	ProtocolV1: 1,
+	ProtocolV2: 2,
+}
+
+// Version return the tcpb protocol version negotiated on ws, 0 for legacy peers
+// without subprotocol which are relayed as raw binary like version 1.
+func Version(ws *websocket.Conn) int {
+	return protocolVersions[ws.Subprotocol()]
+}
+
+// isPayload report whether a message of messageType carry payload in protocol version v.
+func isPayload(v, messageType int) bool {
+	return v < 2 || messageType == websocket.BinaryMessage
+}
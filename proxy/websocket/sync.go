@@ -2,11 +2,12 @@ package websocket
 
 import (
 	"io"
-	"log"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/wuhuizuo/tcpb/logging"
+
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 )
@@ -17,23 +18,37 @@ const (
 	bufferLen = 32768 // 32 KByte
 )
 
+// SyncConn relay data between websocket and tcp connection until one side closed.
 func SyncConn(ws *websocket.Conn, tcp net.Conn, wsHeartInterval time.Duration) (err error) {
+	return SyncConnWithLogger(ws, tcp, wsHeartInterval, nil)
+}
+
+// SyncConnWithLogger relay like SyncConn, logger can be nil for logging.Default().
+func SyncConnWithLogger(ws *websocket.Conn, tcp net.Conn, wsHeartInterval time.Duration, logger logging.Logger) (err error) {
+	return SyncCompressedConn(ws, tcp, Compression{}, wsHeartInterval, logger)
+}
+
+// SyncCompressedConn relay like SyncConn, messages to websocket are compressed by c
+// when permessage-deflate is negotiated, c.Setup should be done before.
+func SyncCompressedConn(ws *websocket.Conn, tcp net.Conn, c Compression, wsHeartInterval time.Duration, logger logging.Logger) (err error) {
 	var wsWriteMutex *sync.Mutex
+	logger = logging.Or(logger)
 
 	if wsHeartInterval > 0 {
 		wsWriteMutex = new(sync.Mutex)
-		heartStop := wsHeartHandler(ws, wsHeartInterval, wsWriteMutex)
+		heartStop := wsHeartHandler(ws, wsHeartInterval, wsWriteMutex, logger)
 		defer func() { heartStop <- true }()
 	}
 
-	errWS2tcp := ctrlWorker(func() error { return ws2tcp(ws, tcp) })
-	errTCP2ws := ctrlWorker(func() error { return tcp2ws(tcp, ws, wsWriteMutex) })
+	version := Version(ws)
+	errWS2tcp := ctrlWorker(func() error { return ws2tcp(ws, tcp, version) })
+	errTCP2ws := ctrlWorker(func() error { return tcp2ws(tcp, ws, c, wsWriteMutex, logger) })
 
 	select {
 	case err = <-errWS2tcp:
-		log.Printf("[INFO ] disconnected: ws://%s -> tcp://%s %+v\n", ws.LocalAddr(), tcp.RemoteAddr(), err)
+		logger.Log(logging.LevelInfo, "disconnected", "from", "ws://"+ws.LocalAddr().String(), "to", "tcp://"+tcp.RemoteAddr().String(), "err", err)
 	case err = <-errTCP2ws:
-		log.Printf("[INFO ] disconnected: tcp://%s -> ws://%s %+v\n", tcp.LocalAddr(), ws.RemoteAddr(), err)
+		logger.Log(logging.LevelInfo, "disconnected", "from", "tcp://"+tcp.LocalAddr().String(), "to", "ws://"+ws.RemoteAddr().String(), "err", err)
 	}
 
 	return err
@@ -54,12 +69,12 @@ func ctrlWorker(loopFn func() error) <-chan error {
 	return errCh
 }
 
-func ws2tcp(from *websocket.Conn, to net.Conn) error {
-	_, buf, err := from.ReadMessage()
+func ws2tcp(from *websocket.Conn, to net.Conn, version int) error {
+	messageType, buf, err := from.ReadMessage()
 	if err != nil {
 		return err
 	}
-	if len(buf) == 0 {
+	if len(buf) == 0 || !isPayload(version, messageType) {
 		return nil
 	}
 
@@ -74,7 +89,7 @@ func ws2tcp(from *websocket.Conn, to net.Conn) error {
 	return nil
 }
 
-func tcp2ws(from net.Conn, to *websocket.Conn, wsWriteMux *sync.Mutex) error {
+func tcp2ws(from net.Conn, to *websocket.Conn, c Compression, wsWriteMux *sync.Mutex, logger logging.Logger) error {
 	buf := make([]byte, bufferLen)
 	n, err := from.Read(buf)
 
@@ -84,15 +99,15 @@ func tcp2ws(from net.Conn, to *websocket.Conn, wsWriteMux *sync.Mutex) error {
 			return nil
 		}
 
-		if wsWriteMux == nil {
-			return to.WriteMessage(websocket.BinaryMessage, buf[:n])
+		if wsWriteMux != nil {
+			wsWriteMux.Lock()
+			defer wsWriteMux.Unlock()
 		}
 
-		wsWriteMux.Lock()
-		defer wsWriteMux.Unlock()
+		c.prepare(to, n)
 		return to.WriteMessage(websocket.BinaryMessage, buf[:n])
 	default:
-		log.Printf("[ERROR]] tcp2ws read err from tcp %s\n", err)
+		logger.Log(logging.LevelError, "tcp2ws read from tcp failed", "err", err)
 		return err
 	}
 }
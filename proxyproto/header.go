@@ -0,0 +1,261 @@
+// Package proxyproto implement the HAProxy PROXY protocol v1 and v2 headers,
+// see https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	// ErrNoHeader is returned when the connection does not start with a PROXY header.
+	ErrNoHeader = errors.New("no proxy protocol header")
+)
+
+const (
+	v1MaxLen = 107 // including CRLF.
+
+	v2CmdLocal = 0x20
+	v2CmdProxy = 0x21
+
+	v2FamilyUnspec = 0x00
+	v2FamilyTCP4   = 0x11
+	v2FamilyTCP6   = 0x21
+)
+
+// Header is a PROXY protocol header, Source and Destination are the client
+// address and the address it connected to, they are nil for local connections
+// like health checks of the load balancer.
+type Header struct {
+	Version     int // 1 or 2.
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// Format return the header in wire format, tcp addresses of different ip
+// families are both formatted as ipv6, other addresses are formatted as unknown.
+func (h *Header) Format() ([]byte, error) {
+	src, dst := tcpAddr(h.Source), tcpAddr(h.Destination)
+
+	switch h.Version {
+	case 1:
+		return formatV1(src, dst), nil
+	case 2:
+		return formatV2(src, dst), nil
+	default:
+		return nil, errors.Errorf("unsupported proxy protocol version %d", h.Version)
+	}
+}
+
+// WriteTo write the header to w.
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	b, err := h.Format()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(b)
+	return int64(n), errors.WithStack(err)
+}
+
+func formatV1(src, dst *net.TCPAddr) []byte {
+	if src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family, srcIP, dstIP := "TCP4", src.IP.String(), dst.IP.String()
+	if !isIPv4(src, dst) {
+		family, srcIP, dstIP = "TCP6", ipv6String(src.IP), ipv6String(dst.IP)
+	}
+
+	return []byte(strings.Join([]string{
+		"PROXY", family, srcIP, dstIP, strconv.Itoa(src.Port), strconv.Itoa(dst.Port),
+	}, " ") + "\r\n")
+}
+
+// isIPv4 report whether both addresses are ipv4, otherwise they are formatted as ipv6.
+func isIPv4(src, dst *net.TCPAddr) bool {
+	return src.IP.To4() != nil && dst.IP.To4() != nil
+}
+
+// ipv6String return ip in ipv6 text form, ipv4 is formatted as ipv4-mapped address.
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+
+	return ip.String()
+}
+
+func formatV2(src, dst *net.TCPAddr) []byte {
+	var buf bytes.Buffer
+	buf.Write(v2Signature)
+
+	if src == nil || dst == nil {
+		buf.Write([]byte{v2CmdLocal, v2FamilyUnspec, 0, 0})
+		return buf.Bytes()
+	}
+
+	family, srcIP, dstIP := byte(v2FamilyTCP4), src.IP.To4(), dst.IP.To4()
+	if !isIPv4(src, dst) {
+		family, srcIP, dstIP = v2FamilyTCP6, src.IP.To16(), dst.IP.To16()
+	}
+
+	buf.Write([]byte{v2CmdProxy, family})
+	_ = binary.Write(&buf, binary.BigEndian, uint16(2*len(srcIP)+4))
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	_ = binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+	_ = binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+
+	return buf.Bytes()
+}
+
+// tcpAddr return addr as *net.TCPAddr, nil when it is not an ip address.
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a == nil || a.IP == nil {
+			return nil
+		}
+		return a
+	case *net.UDPAddr:
+		if a == nil || a.IP == nil {
+			return nil
+		}
+		return &net.TCPAddr{IP: a.IP, Port: a.Port}
+	case nil:
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return nil
+	}
+
+	return &net.TCPAddr{IP: ip, Port: p}
+}
+
+// Read read a v1 or v2 header from r, it returns ErrNoHeader when r does not
+// start with a header.
+func Read(r *bufio.Reader) (*Header, error) {
+	b, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if bytes.Equal(b, v1Prefix) {
+		return readV1(r)
+	}
+
+	b, err = r.Peek(len(v2Signature))
+	if err == nil && bytes.Equal(b, v2Signature) {
+		return readV2(r)
+	}
+
+	return nil, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxy protocol v1 header is too long")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	h := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.Errorf("invalid proxy protocol v1 header %q", line)
+	}
+
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	h.Source, h.Destination = src, dst
+
+	return h, nil
+}
+
+func parseV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if addr.IP == nil || err != nil {
+		return nil, errors.Errorf("invalid proxy protocol v1 address %s %s", ip, port)
+	}
+	addr.Port = int(p)
+
+	return addr, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	head := make([]byte, len(v2Signature)+4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cmd, family := head[12], head[13]
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	h := &Header{Version: 2}
+	switch cmd {
+	case v2CmdLocal:
+		return h, nil
+	case v2CmdProxy:
+	default:
+		return nil, errors.Errorf("invalid proxy protocol v2 command 0x%x", cmd)
+	}
+
+	var ipLen int
+	switch family >> 4 {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default:
+		// unix or unspecified addresses are ignored like local.
+		return h, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, errors.New("proxy protocol v2 address is truncated")
+	}
+
+	ports := body[2*ipLen:]
+	h.Source = &net.TCPAddr{IP: net.IP(body[:ipLen]), Port: int(binary.BigEndian.Uint16(ports))}
+	h.Destination = &net.TCPAddr{IP: net.IP(body[ipLen : 2*ipLen]), Port: int(binary.BigEndian.Uint16(ports[2:]))}
+
+	return h, nil
+}
@@ -0,0 +1,225 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func tcp(s string) *net.TCPAddr {
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		panic(err)
+	}
+
+	return addr
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  Header
+		wire    string // expected wire format, skipped when empty.
+		src     string // expected source address after parsing, empty for none.
+		dst     string
+		wantErr bool
+	}{
+		{
+			name:   "v1 ipv4",
+			header: Header{Version: 1, Source: tcp("192.168.0.1:56324"), Destination: tcp("10.0.0.1:443")},
+			wire:   "PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n",
+			src:    "192.168.0.1:56324",
+			dst:    "10.0.0.1:443",
+		},
+		{
+			name:   "v1 ipv6",
+			header: Header{Version: 1, Source: tcp("[2001:db8::1]:56324"), Destination: tcp("[::1]:443")},
+			wire:   "PROXY TCP6 2001:db8::1 ::1 56324 443\r\n",
+			src:    "[2001:db8::1]:56324",
+			dst:    "[::1]:443",
+		},
+		{
+			name:   "v1 mixed families",
+			header: Header{Version: 1, Source: tcp("192.168.0.1:56324"), Destination: tcp("[::1]:443")},
+			wire:   "PROXY TCP6 ::ffff:192.168.0.1 ::1 56324 443\r\n",
+			src:    "192.168.0.1:56324",
+			dst:    "[::1]:443",
+		},
+		{
+			name:   "v1 udp and string addresses",
+			header: Header{Version: 1, Source: &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5}, Destination: stringAddr("5.6.7.8:9")},
+			wire:   "PROXY TCP4 1.2.3.4 5.6.7.8 5 9\r\n",
+			src:    "1.2.3.4:5",
+			dst:    "5.6.7.8:9",
+		},
+		{
+			name:   "v1 unknown",
+			header: Header{Version: 1, Source: stringAddr("/run/app.sock"), Destination: tcp("10.0.0.1:443")},
+			wire:   "PROXY UNKNOWN\r\n",
+		},
+		{
+			name:   "v1 without addresses",
+			header: Header{Version: 1, Source: (*net.TCPAddr)(nil)},
+			wire:   "PROXY UNKNOWN\r\n",
+		},
+		{
+			name:   "v2 ipv4",
+			header: Header{Version: 2, Source: tcp("192.168.0.1:56324"), Destination: tcp("10.0.0.1:443")},
+			wire: "\r\n\r\n\x00\r\nQUIT\n" + "\x21\x11\x00\x0c" +
+				"\xc0\xa8\x00\x01" + "\x0a\x00\x00\x01" + "\xdc\x04" + "\x01\xbb",
+			src: "192.168.0.1:56324",
+			dst: "10.0.0.1:443",
+		},
+		{
+			name:   "v2 ipv6",
+			header: Header{Version: 2, Source: tcp("[2001:db8::1]:56324"), Destination: tcp("[::1]:443")},
+			wire: "\r\n\r\n\x00\r\nQUIT\n" + "\x21\x21\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\xdc\x04" + "\x01\xbb",
+			src: "[2001:db8::1]:56324",
+			dst: "[::1]:443",
+		},
+		{
+			name:   "v2 mixed families",
+			header: Header{Version: 2, Source: tcp("192.168.0.1:56324"), Destination: tcp("[::1]:443")},
+			src:    "192.168.0.1:56324",
+			dst:    "[::1]:443",
+		},
+		{
+			name:   "v2 local",
+			header: Header{Version: 2},
+			wire:   "\r\n\r\n\x00\r\nQUIT\n" + "\x20\x00\x00\x00",
+		},
+		{
+			name:    "unsupported version",
+			header:  Header{Version: 3},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			_, err := tt.header.WriteTo(&buf)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("WriteTo() got %q, want error", buf.Bytes())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("WriteTo() error = %v", err)
+			}
+			if tt.wire != "" && buf.String() != tt.wire {
+				t.Errorf("WriteTo() = %q, want %q", buf.Bytes(), tt.wire)
+			}
+
+			buf.WriteString("payload")
+			r := bufio.NewReader(&buf)
+			h, err := Read(r)
+			if err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+			if h.Version != tt.header.Version {
+				t.Errorf("Read() version = %d, want %d", h.Version, tt.header.Version)
+			}
+			assertAddr(t, "source", h.Source, tt.src)
+			assertAddr(t, "destination", h.Destination, tt.dst)
+
+			if rest, _ := ioutil.ReadAll(r); string(rest) != "payload" {
+				t.Errorf("data after header = %q, want %q", rest, "payload")
+			}
+		})
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	v2 := "\r\n\r\n\x00\r\nQUIT\n"
+	tests := []struct {
+		name  string
+		input string
+		want  error // checked by errors.Is when not nil.
+	}{
+		{name: "empty", input: "", want: io.EOF},
+		{name: "short", input: "PRO", want: io.EOF},
+		{name: "http request", input: "GET / HTTP/1.1\r\nHost: a\r\n\r\n", want: ErrNoHeader},
+		{name: "binary garbage", input: "\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03\x00\x00", want: ErrNoHeader},
+		{name: "v2 signature prefix only", input: "\r\n\r\n\x00\r\nQU", want: ErrNoHeader},
+		{name: "v1 without crlf", input: "PROXY TCP4 1.2.3.4 5.6.7.8 1 2", want: io.EOF},
+		{name: "v1 lf only", input: "PROXY TCP4 1.2.3.4 5.6.7.8 1 2\n"},
+		{name: "v1 too long", input: "PROXY TCP6 " + strings.Repeat("f", 120) + "\r\n"},
+		{name: "v1 missing fields", input: "PROXY TCP4 1.2.3.4 5.6.7.8 1\r\n"},
+		{name: "v1 unknown family", input: "PROXY UDP4 1.2.3.4 5.6.7.8 1 2\r\n"},
+		{name: "v1 invalid ip", input: "PROXY TCP4 1.2.3 5.6.7.8 1 2\r\n"},
+		{name: "v1 invalid port", input: "PROXY TCP4 1.2.3.4 5.6.7.8 1 65536\r\n"},
+		{name: "v2 truncated head", input: v2 + "\x21\x11\x00", want: io.ErrUnexpectedEOF},
+		{name: "v2 truncated body", input: v2 + "\x21\x11\x00\x0c\xc0\xa8\x00\x01", want: io.ErrUnexpectedEOF},
+		{name: "v2 invalid command", input: v2 + "\x22\x11\x00\x00"},
+		{name: "v2 invalid version", input: v2 + "\x11\x11\x00\x00"},
+		{name: "v2 short ipv4 address", input: v2 + "\x21\x11\x00\x08\xc0\xa8\x00\x01\x0a\x00\x00\x01"},
+		{name: "v2 short ipv6 address", input: v2 + "\x21\x21\x00\x0c" + strings.Repeat("\x00", 12)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := Read(bufio.NewReader(strings.NewReader(tt.input)))
+			if err == nil {
+				t.Fatalf("Read() = %+v, want error", h)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("Read() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadV2Unspecified(t *testing.T) {
+	// proxied unix sockets and unspecified families carry no ip addresses.
+	for _, family := range []string{"\x00", "\x31"} {
+		input := "\r\n\r\n\x00\r\nQUIT\n\x21" + family + "\x00\x04abcd" + "payload"
+		r := bufio.NewReader(strings.NewReader(input))
+		h, err := Read(r)
+		if err != nil {
+			t.Fatalf("Read() family %q error = %v", family, err)
+		}
+		if h.Version != 2 || h.Source != nil || h.Destination != nil {
+			t.Errorf("Read() family %q = %+v, want v2 without addresses", family, h)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "payload" {
+			t.Errorf("data after header = %q, want %q", rest, "payload")
+		}
+	}
+}
+
+func assertAddr(t *testing.T, name string, got net.Addr, want string) {
+	t.Helper()
+
+	if want == "" {
+		if got != nil {
+			t.Errorf("%s = %v, want none", name, got)
+		}
+		return
+	}
+
+	addr, ok := got.(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("%s = %#v, want *net.TCPAddr", name, got)
+	}
+	wantAddr := tcp(want)
+	if !addr.IP.Equal(wantAddr.IP) || addr.Port != wantAddr.Port {
+		t.Errorf("%s = %v, want %v", name, addr, want)
+	}
+}
+
+// stringAddr is a net.Addr known only by its string.
+type stringAddr string
+
+func (a stringAddr) Network() string { return "tcp" }
+func (a stringAddr) String() string  { return string(a) }
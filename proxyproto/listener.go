@@ -0,0 +1,101 @@
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultHeaderTimeout is the default max duration waiting the header of an accepted connection.
+const DefaultHeaderTimeout = 10 * time.Second
+
+// Listener accept connections starting with a PROXY header, the remote
+// address of the connection is the source address in the header.
+type Listener struct {
+	net.Listener
+
+	// HeaderTimeout is the max duration waiting the header, default DefaultHeaderTimeout.
+	HeaderTimeout time.Duration
+}
+
+// NewListener return a listener requiring PROXY headers on connections accepted by l.
+func NewListener(l net.Listener) *Listener {
+	return &Listener{Listener: l}
+}
+
+// Accept implement net.Listener, the header is read on the first read or
+// address query, so a slow client does not block accepting others.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := l.HeaderTimeout
+	if timeout <= 0 {
+		timeout = DefaultHeaderTimeout
+	}
+
+	return &conn{Conn: c, r: bufio.NewReader(c), timeout: timeout}, nil
+}
+
+// conn is a connection with PROXY header, the connection is closed when the header is invalid.
+type conn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	header *Header
+	err    error
+}
+
+func (c *conn) readHeader() error {
+	c.once.Do(func() {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+			c.err = errors.WithStack(err)
+			return
+		}
+
+		c.header, c.err = Read(c.r)
+		if err := c.Conn.SetReadDeadline(time.Time{}); err != nil && c.err == nil {
+			c.err = errors.WithStack(err)
+		}
+		if c.err != nil {
+			c.err = errors.Wrapf(c.err, "read proxy protocol header from %s failed", c.Conn.RemoteAddr())
+			_ = c.Conn.Close()
+		}
+	})
+
+	return c.err
+}
+
+// Read implement net.Conn.
+func (c *conn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+
+	return c.r.Read(b)
+}
+
+// RemoteAddr implement net.Conn, it returns the source address in the header.
+func (c *conn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.header.Source != nil {
+		return c.header.Source
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr implement net.Conn, it returns the destination address in the header.
+func (c *conn) LocalAddr() net.Addr {
+	if c.readHeader() == nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,223 @@
+package resolve
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+// ip families to dial.
+const (
+	FamilyAny = "any"
+	FamilyIP4 = "ip4"
+	FamilyIP6 = "ip6"
+)
+
+// DefaultFallbackDelay is the delay before racing the next address with happy eyeballs.
+const DefaultFallbackDelay = 300 * time.Millisecond
+
+// ParseFamily check the family, empty for FamilyAny.
+func ParseFamily(s string) (string, error) {
+	switch s {
+	case "", FamilyAny:
+		return FamilyAny, nil
+	case FamilyIP4, FamilyIP6:
+		return s, nil
+	default:
+		return "", errors.Errorf("unknown ip family %q, any|ip4|ip6", s)
+	}
+}
+
+// Dialer resolve host names with Resolver and dial the addresses with Forward.
+type Dialer struct {
+	Resolver Resolver // net.DefaultResolver when nil.
+	Family   string   // FamilyAny, FamilyIP4 or FamilyIP6, empty for any.
+
+	// HappyEyeballs race the addresses alternating ipv6 and ipv4(RFC 8305), the next
+	// is started after FallbackDelay or once the previous failed. Addresses are tried
+	// one by one in order of resolution otherwise.
+	HappyEyeballs bool
+	FallbackDelay time.Duration
+
+	Forward proxy.ContextDialer // dial resolved ip addresses, a net.Dialer when nil.
+}
+
+// Dial implement proxy.Dialer.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext implement proxy.ContextDialer, addresses other than tcp or udp host:port
+// are dialed as is.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || !strings.HasPrefix(network, "tcp") && !strings.HasPrefix(network, "udp") {
+		return d.forward().DialContext(ctx, network, address)
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := or(d.Resolver).LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	ips = filterFamily(ips, d.family(network))
+	if len(ips) == 0 {
+		return nil, errors.Errorf("no %s address of %s", d.family(network), host)
+	}
+
+	if d.HappyEyeballs && len(ips) > 1 {
+		return d.race(ctx, network, port, interleave(ips))
+	}
+
+	var errs []string
+	for _, ip := range ips {
+		c, err := d.forward().DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return c, nil
+		}
+		errs = append(errs, err.Error())
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Errorf("dial %s %s: %s", network, address, strings.Join(errs, "; "))
+}
+
+// race dial ips in order, the next is started after the fallback delay or once
+// the previous failed, the first connected wins and others are closed.
+func (d *Dialer) race(ctx context.Context, network, port string, ips []net.IP) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	results := make(chan result, len(ips))
+	start := func(ip net.IP) {
+		go func() {
+			c, err := d.forward().DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			results <- result{c, err}
+		}()
+	}
+
+	delay := d.FallbackDelay
+	if delay <= 0 {
+		delay = DefaultFallbackDelay
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	// closeLate close connections of the pending dials when returning early.
+	closeLate := func(n int) {
+		go func() {
+			for ; n > 0; n-- {
+				if r := <-results; r.c != nil {
+					r.c.Close()
+				}
+			}
+		}()
+	}
+
+	start(ips[0])
+	next, pending := 1, 1
+	var errs []string
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				closeLate(pending)
+				return r.c, nil
+			}
+			errs = append(errs, r.err.Error())
+		case <-timer.C:
+		case <-ctx.Done():
+			closeLate(pending)
+			return nil, errors.WithStack(ctx.Err())
+		}
+
+		if next < len(ips) {
+			start(ips[next])
+			next++
+			pending++
+			timer.Reset(delay)
+		}
+	}
+
+	return nil, errors.Errorf("dial %s port %s: %s", network, port, strings.Join(errs, "; "))
+}
+
+func (d *Dialer) forward() proxy.ContextDialer {
+	if d.Forward == nil {
+		return &net.Dialer{}
+	}
+
+	return d.Forward
+}
+
+// family return the ip family to dial, networks like tcp4 have priority.
+func (d *Dialer) family(network string) string {
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return FamilyIP4
+	case strings.HasSuffix(network, "6"):
+		return FamilyIP6
+	case d.Family == "":
+		return FamilyAny
+	default:
+		return d.Family
+	}
+}
+
+func filterFamily(ips []net.IP, family string) []net.IP {
+	if family == FamilyAny {
+		return ips
+	}
+
+	var ret []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (family == FamilyIP4) {
+			ret = append(ret, ip)
+		}
+	}
+
+	return ret
+}
+
+// interleave order ips alternating families, starting with the family of the first.
+func interleave(ips []net.IP) []net.IP {
+	var first, second []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (ips[0].To4() != nil) {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+
+	ret := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ret = append(ret, first[i])
+		}
+		if i < len(second) {
+			ret = append(ret, second[i])
+		}
+	}
+
+	return ret
+}
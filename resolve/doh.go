@@ -0,0 +1,167 @@
+package resolve
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dohContentType = "application/dns-message"
+	dohMaxResponse = 65535
+)
+
+// DoH resolve hosts by DNS-over-HTTPS(RFC 8484) queries posted to URL.
+type DoH struct {
+	URL string
+
+	// Client send the queries, it can dial through tunnels, http.DefaultClient when nil.
+	Client *http.Client
+}
+
+// LookupIPAddr implement Resolver, AAAA and A records are queried concurrently,
+// ipv6 addresses come first.
+func (r *DoH) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	types := []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA}
+	answers := make([][]net.IPAddr, len(types))
+	errs := make([]error, len(types))
+	var wg sync.WaitGroup
+	for i, t := range types {
+		wg.Add(1)
+		go func(i int, t dnsmessage.Type) {
+			defer wg.Done()
+			answers[i], errs[i] = r.query(ctx, host, t)
+		}(i, t)
+	}
+	wg.Wait()
+
+	var (
+		addrs []net.IPAddr
+		msgs  []string
+	)
+	for i := range types {
+		addrs = append(addrs, answers[i]...)
+		if errs[i] != nil {
+			msgs = append(msgs, errs[i].Error())
+		}
+	}
+	if len(addrs) == 0 {
+		if len(msgs) > 0 {
+			return nil, errors.Errorf("lookup %s: %s", host, strings.Join(msgs, "; "))
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return addrs, nil
+}
+
+// query send a query of type t for host and return the addresses answered.
+func (r *DoH) query(ctx context.Context, host string, t dnsmessage.Type) ([]net.IPAddr, error) {
+	name, err := dnsmessage.NewName(dnsFQDN(host))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// id is 0 for http caching, as recommended by RFC 8484.
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: t, Class: dnsmessage.ClassINET}},
+	}
+	body, err := msg.Pack()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, r.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("doh server responded %s", resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, dohMaxResponse))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return parseAnswers(b)
+}
+
+// parseAnswers return the A and AAAA addresses in a DNS response.
+func parseAnswers(b []byte) ([]net.IPAddr, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if h.RCode != dnsmessage.RCodeSuccess {
+		return nil, errors.Errorf("dns response code %s", h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var addrs []net.IPAddr
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			return addrs, nil
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		switch ah.Type {
+		case dnsmessage.TypeA:
+			a, err := p.AResource()
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			addrs = append(addrs, net.IPAddr{IP: net.IP(a.A[:])})
+		case dnsmessage.TypeAAAA:
+			aaaa, err := p.AAAAResource()
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			addrs = append(addrs, net.IPAddr{IP: net.IP(aaaa.AAAA[:])})
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+	}
+}
+
+func dnsFQDN(host string) string {
+	if strings.HasSuffix(host, ".") {
+		return host
+	}
+
+	return host + "."
+}
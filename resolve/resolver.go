@@ -0,0 +1,148 @@
+// Package resolve implement configurable name resolution for dialing: static
+// host overrides, a specific DNS server and DNS-over-HTTPS.
+package resolve
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+// dohTimeout bound the queries to DoH servers.
+const dohTimeout = 10 * time.Second
+
+// Resolver look up the ip addresses of hosts, *net.Resolver implement it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Hosts override the addresses of hosts, others are looked up by Next.
+type Hosts struct {
+	Addrs map[string][]net.IPAddr // lower case host -> addresses.
+	Next  Resolver                // net.DefaultResolver when nil.
+}
+
+// ParseHosts parse host overrides in format host=ip, repeat a host for more addresses.
+func ParseHosts(entries []string) (map[string][]net.IPAddr, error) {
+	addrs := make(map[string][]net.IPAddr)
+	for _, e := range entries {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.Errorf("invalid host override %q, format: host=ip", e)
+		}
+		ip := net.ParseIP(kv[1])
+		if ip == nil {
+			return nil, errors.Errorf("invalid ip in host override %q", e)
+		}
+
+		host := strings.ToLower(strings.TrimSuffix(kv[0], "."))
+		addrs[host] = append(addrs[host], net.IPAddr{IP: ip})
+	}
+
+	return addrs, nil
+}
+
+// LookupIPAddr implement Resolver.
+func (h *Hosts) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if addrs, ok := h.Addrs[strings.ToLower(strings.TrimSuffix(host, "."))]; ok {
+		return addrs, nil
+	}
+
+	return or(h.Next).LookupIPAddr(ctx, host)
+}
+
+// NewDNS return the resolver querying the DNS server at addr, port 53 when omitted.
+func NewDNS(addr string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// or return r, or net.DefaultResolver when r is nil.
+func or(r Resolver) Resolver {
+	if r == nil {
+		return net.DefaultResolver
+	}
+
+	return r
+}
+
+// Config of resolving for dialers, mostly from command line flags.
+type Config struct {
+	Hosts         []string // host overrides in format host=ip.
+	DNSServer     string   // host[:port] of the DNS server, system resolver when empty.
+	DoHURL        string   // DNS-over-HTTPS url, it has priority over DNSServer.
+	Family        string   // FamilyAny, FamilyIP4 or FamilyIP6.
+	HappyEyeballs bool
+}
+
+// Empty report whether c change nothing of system resolving.
+func (c *Config) Empty() bool {
+	return len(c.Hosts) == 0 && c.DNSServer == "" && c.DoHURL == "" &&
+		(c.Family == "" || c.Family == FamilyAny) && !c.HappyEyeballs
+}
+
+// NewDialer return the dialer resolving by c and dialing with forward. DoH queries
+// are dialed with doh so they can go through tunnels, nil for forward with the
+// resolving of c except DoH.
+func (c *Config) NewDialer(forward, doh proxy.ContextDialer) (*Dialer, error) {
+	hosts, err := ParseHosts(c.Hosts)
+	if err != nil {
+		return nil, err
+	}
+	family, err := ParseFamily(c.Family)
+	if err != nil {
+		return nil, err
+	}
+
+	var next Resolver
+	if c.DNSServer != "" {
+		next = NewDNS(c.DNSServer)
+	}
+	d := &Dialer{Resolver: &Hosts{Addrs: hosts, Next: next}, Family: family, HappyEyeballs: c.HappyEyeballs, Forward: forward}
+	if c.DoHURL == "" {
+		return d, nil
+	}
+
+	u, err := url.Parse(c.DoHURL)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, errors.Errorf("unsupported doh url scheme %q", u.Scheme)
+	}
+	if doh == nil {
+		base := *d
+		doh = &base
+	}
+	d.Resolver = &Hosts{Addrs: hosts, Next: &DoH{URL: c.DoHURL, Client: newDoHClient(doh)}}
+
+	return d, nil
+}
+
+// newDoHClient return the http client dialing DoH servers with d.
+func newDoHClient(d proxy.ContextDialer) *http.Client {
+	return &http.Client{
+		Timeout: dohTimeout,
+		Transport: &http.Transport{
+			DialContext:         d.DialContext,
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: dohTimeout,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
@@ -0,0 +1,334 @@
+package tcpb
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wuhuizuo/tcpb/logging"
+	ws "github.com/wuhuizuo/tcpb/proxy/websocket"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// Reasons of session end reported in Stats.
+const (
+	ReasonClosed      = "closed"       // a peer closed the connection or relaying failed.
+	ReasonIdle        = "idle"         // no payload moved for the idle timeout.
+	ReasonMaxDuration = "max-duration" // the session lasted for the max duration.
+	ReasonMaxBytes    = "max-bytes"    // the payload reached the max bytes.
+)
+
+// Websocket close codes sent to the peer when a session is stopped by limits.
+const (
+	CloseIdle        = 4000
+	CloseMaxDuration = 4001
+	CloseMaxBytes    = 4002
+)
+
+var closeCodes = map[string]int{
+	ReasonIdle:        CloseIdle,
+	ReasonMaxDuration: CloseMaxDuration,
+	ReasonMaxBytes:    CloseMaxBytes,
+}
+
+var errMaxBytes = errors.New("session max bytes reached")
+
+// Stats is the summary of a tunnel session reported when it end.
+type Stats struct {
+	Target   string
+	Resolved string // address the target resolved to, empty when unknown.
+	Up       int64  // payload bytes from client to target.
+	Down     int64  // payload bytes from target to client.
+	Duration time.Duration
+	Reason   string
+	Err      error
+
+	// Version is the tcpb protocol version negotiated on websocket tunnels, see
+	// ws.Version, 0 for legacy peers and other transports.
+	Version int
+
+	// Compression is the ratio of payload to websocket wire bytes with framing of
+	// sessions with permessage-deflate negotiated, 0 otherwise or when unknown.
+	Compression float64
+}
+
+// session track the payload of a tunnel session and stop it when limits reached.
+type session struct {
+	up, down int64 // atomic, first for 64-bit alignment.
+	active   int64 // atomic, unix nano of the last payload.
+	used     int64 // atomic, bytes taken from the max bytes quota.
+
+	bridge   *Bridge
+	target   string
+	resolved string
+	start    time.Time
+	version  int          // negotiated tcpb protocol version of websocket tunnels.
+	wire     *ws.WireConn // websocket tunnel connection counted for compression, nil when unknown.
+
+	mu     sync.Mutex
+	reason string
+	stops  []func()
+	done   chan struct{}
+}
+
+// newSession start a session to target connected at resolved address.
+func (b *Bridge) newSession(target string, resolved net.Addr) *session {
+	now := time.Now()
+	s := &session{bridge: b, target: target, start: now, active: now.UnixNano(), done: make(chan struct{})}
+	if resolved != nil {
+		s.resolved = resolved.String()
+	}
+
+	if b.OnSessionStart != nil {
+		b.OnSessionStart(Stats{Target: s.target, Resolved: s.resolved})
+	}
+
+	return s
+}
+
+// targetAddr return the address the target of c resolved to. Connections dialed
+// through proxies report it by a TargetAddr method, nil when the proxy resolved it.
+func targetAddr(c net.Conn) net.Addr {
+	if tc, ok := c.(interface{ TargetAddr() net.Addr }); ok {
+		return tc.TargetAddr()
+	}
+
+	return c.RemoteAddr()
+}
+
+// clientConn wrap the client side connection: reading is up and writing is down.
+func (s *session) clientConn(c net.Conn) net.Conn {
+	return s.bridge.throttleClient(&meteredConn{Conn: c, s: s, read: &s.up, write: &s.down})
+}
+
+// targetConn wrap the target side connection: writing is up and reading is down.
+func (s *session) targetConn(c net.Conn) net.Conn {
+	return s.bridge.throttleTarget(&meteredConn{Conn: c, s: s, read: &s.down, write: &s.up})
+}
+
+// onStop register fn to be called when the session is stopped by limits, it
+// should close the connections to end the relaying.
+func (s *session) onStop(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stops = append(s.stops, fn)
+}
+
+// closeOnStop close c when the session is stopped by limits.
+func (s *session) closeOnStop(c net.Conn) {
+	s.onStop(func() { _ = c.Close() })
+}
+
+// closeWSOnStop send a close frame with the code of the stop reason to ws, then close it.
+func (s *session) closeWSOnStop(ws *websocket.Conn) {
+	s.onStop(func() {
+		msg := websocket.FormatCloseMessage(closeCodes[s.stopReason()], s.stopReason())
+		_ = ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		_ = ws.Close()
+	})
+}
+
+// watch stop the session after no payload for idle or lasting for the bridge
+// MaxDuration, 0 for never.
+func (s *session) watch(idle time.Duration) {
+	maxDuration := s.bridge.MaxDuration
+	if idle <= 0 && maxDuration <= 0 {
+		return
+	}
+
+	interval := checkInterval(idle)
+	if maxDuration > 0 && (idle <= 0 || checkInterval(maxDuration) < interval) {
+		interval = checkInterval(maxDuration)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.done:
+				return
+			case now := <-ticker.C:
+				if maxDuration > 0 && now.Sub(s.start) >= maxDuration {
+					s.stop(ReasonMaxDuration)
+					return
+				}
+				if idle > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&s.active))) >= idle {
+					s.stop(ReasonIdle)
+					return
+				}
+			}
+		}
+	}()
+}
+
+// take reserve n bytes from the bridge MaxBytes quota, it returns the bytes
+// allowed and whether the quota is used up.
+func (s *session) take(n int) (int, bool) {
+	maxBytes := s.bridge.MaxBytes
+	if maxBytes <= 0 || n <= 0 {
+		return n, false
+	}
+
+	used := atomic.AddInt64(&s.used, int64(n))
+	if used < maxBytes {
+		return n, false
+	}
+	if allowed := int64(n) - (used - maxBytes); allowed > 0 {
+		return int(allowed), true
+	}
+
+	return 0, true
+}
+
+func (s *session) stopReason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.reason
+}
+
+// stop end the session for reason, only the first reason is kept.
+func (s *session) stop(reason string) {
+	s.mu.Lock()
+	if s.reason != "" {
+		s.mu.Unlock()
+		return
+	}
+	s.reason = reason
+	stops := s.stops
+	s.mu.Unlock()
+
+	logging.Or(s.bridge.Logger).Log(logging.LevelInfo, "stopping session", "target", s.target, "reason", reason)
+	for _, fn := range stops {
+		fn()
+	}
+}
+
+// end finish the session with the relaying error and report the stats, the
+// returned error tells the reason when the session is stopped by limits.
+func (s *session) end(err error) error {
+	close(s.done)
+
+	s.mu.Lock()
+	reason := s.reason
+	if reason == "" {
+		reason = peerReason(err)
+		s.reason = reason
+	}
+	s.mu.Unlock()
+
+	if reason != ReasonClosed {
+		err = errors.Errorf("session stopped: %s", reason)
+	}
+
+	stats := Stats{
+		Target:   s.target,
+		Resolved: s.resolved,
+		Up:       atomic.LoadInt64(&s.up),
+		Down:     atomic.LoadInt64(&s.down),
+		Duration: time.Since(s.start),
+		Reason:   reason,
+		Err:      err,
+		Version:  s.version,
+	}
+	if wire := s.wireBytes(); wire > 0 {
+		stats.Compression = float64(stats.Up+stats.Down) / float64(wire)
+	}
+	if s.bridge.OnSessionEnd != nil {
+		s.bridge.OnSessionEnd(stats)
+	}
+
+	return err
+}
+
+func (s *session) wireBytes() int64 {
+	if s.wire == nil {
+		return 0
+	}
+
+	return s.wire.Bytes()
+}
+
+// wireOf return the counted connection under the upgraded websocket connection,
+// see ws.MeterWire, nil when it is not counted.
+func wireOf(c *websocket.Conn) *ws.WireConn {
+	wire, _ := c.UnderlyingConn().(*ws.WireConn)
+	return wire
+}
+
+// peerReason return the reason of the session stopped by the peer with a close code.
+func peerReason(err error) string {
+	if ce, ok := errors.Cause(err).(*websocket.CloseError); ok {
+		for reason, code := range closeCodes {
+			if code == ce.Code {
+				return reason
+			}
+		}
+	}
+
+	return ReasonClosed
+}
+
+// checkInterval return the ticker interval for checking a duration limit.
+func checkInterval(d time.Duration) time.Duration {
+	if d /= 2; d > time.Second {
+		return time.Second
+	}
+	if d < 10*time.Millisecond {
+		return 10 * time.Millisecond
+	}
+
+	return d
+}
+
+// meteredConn count payload bytes moved on the connection.
+type meteredConn struct {
+	net.Conn
+	s           *session
+	read, write *int64
+}
+
+// Read implement net.Conn, the session is stopped after the bytes read use up the quota.
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	allowed, full := c.s.take(n)
+	c.count(c.read, allowed)
+	if full {
+		c.s.stop(ReasonMaxBytes)
+		if allowed < n {
+			return allowed, errMaxBytes
+		}
+	}
+
+	return allowed, err
+}
+
+// Write implement net.Conn, only bytes within the quota are written.
+func (c *meteredConn) Write(b []byte) (int, error) {
+	allowed, full := c.s.take(len(b))
+	n, err := c.Conn.Write(b[:allowed])
+	c.count(c.write, n)
+	if full {
+		c.s.stop(ReasonMaxBytes)
+		if err == nil && allowed < len(b) {
+			err = errMaxBytes
+		}
+	}
+
+	return n, err
+}
+
+func (c *meteredConn) count(counter *int64, n int) {
+	if n <= 0 {
+		return
+	}
+
+	atomic.AddInt64(counter, int64(n))
+	atomic.StoreInt64(&c.s.active, time.Now().UnixNano())
+}
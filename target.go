@@ -0,0 +1,110 @@
+package tcpb
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	netproxy "golang.org/x/net/proxy"
+)
+
+// target network prefixes, target without prefix is tcp "host:port".
+const (
+	udpTargetPrefix  = "udp:"
+	unixTargetPrefix = "unix:"
+)
+
+// ParseTarget split the tunnel target into network and address:
+// "udp:host:port" for udp, "unix:/path" for unix socket and "host:port" for tcp.
+func ParseTarget(target string) (network, address string) {
+	switch {
+	case strings.HasPrefix(target, udpTargetPrefix):
+		return "udp", strings.TrimPrefix(target, udpTargetPrefix)
+	case strings.HasPrefix(target, unixTargetPrefix):
+		return "unix", strings.TrimPrefix(target, unixTargetPrefix)
+	default:
+		return "tcp", target
+	}
+}
+
+// Balancer dial one of the backends of a target.
+type Balancer interface {
+	// DialBackend dial backends with dial, failing over to others when dial fails.
+	DialBackend(dial func(target string) (net.Conn, error)) (net.Conn, error)
+}
+
+// dialTarget dial the stream target, or a backend chosen by the balancer.
+func (b *Bridge) dialTarget(target string) (net.Conn, error) {
+	if b.Balancer != nil {
+		return b.Balancer.DialBackend(b.dialStream)
+	}
+
+	return b.dialStream(target)
+}
+
+// dialStream dial the stream target, tcp "host:port" or unix socket "unix:/path".
+func (b *Bridge) dialStream(target string) (net.Conn, error) {
+	network, address := ParseTarget(target)
+	if network != "tcp" && network != "unix" {
+		return nil, errors.Errorf("unsupported stream target network: %s", network)
+	}
+
+	c, err := b.dial(network, address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dial %s %s failed", network, address)
+	}
+
+	if b.TargetProxyHeader != nil {
+		if _, err := b.TargetProxyHeader.WriteTo(c); err != nil {
+			c.Close()
+			return nil, errors.Wrapf(err, "write proxy protocol header to %s %s failed", network, address)
+		}
+	}
+
+	return c, nil
+}
+
+// dial connect to address on network with the dialer.
+func (b *Bridge) dial(network, address string) (net.Conn, error) {
+	if b.Dialer == nil {
+		return net.Dial(network, address)
+	}
+
+	return b.Dialer.DialContext(context.Background(), network, address)
+}
+
+// forwardDialer return the dialer to reach tunnel servers, proxies from environment
+// are used when no dialer is set.
+func (b *Bridge) forwardDialer() netproxy.Dialer {
+	if b.Dialer == nil {
+		return netproxy.FromEnvironment()
+	}
+
+	return dialerFunc(b.dial)
+}
+
+// tunnelDialer return the dialer of tunnel servers, nil for direct dialing.
+func (b *Bridge) tunnelDialer() netproxy.Dialer {
+	if b.Dialer == nil {
+		return nil
+	}
+
+	return contextDialer{b.Dialer}
+}
+
+// contextDialer implement netproxy.Dialer with a netproxy.ContextDialer.
+type contextDialer struct {
+	netproxy.ContextDialer
+}
+
+func (d contextDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// dialerFunc implement netproxy.Dialer with a function.
+type dialerFunc func(network, address string) (net.Conn, error)
+
+func (f dialerFunc) Dial(network, address string) (net.Conn, error) {
+	return f(network, address)
+}
@@ -3,14 +3,17 @@ package tcpb
 import (
 	"encoding/base64"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
+	"github.com/wuhuizuo/tcpb/logging"
+	"github.com/wuhuizuo/tcpb/proxy/post"
 	ws "github.com/wuhuizuo/tcpb/proxy/websocket"
+	"github.com/wuhuizuo/tcpb/proxyproto"
+	"github.com/wuhuizuo/tcpb/throttle"
 
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
@@ -25,6 +28,54 @@ const (
 type Bridge struct {
 	WSProxyGetter func(*http.Request) (*url.URL, error)
 	HeartInterval time.Duration
+
+	// HTTP2 bootstrap wss tunnels with HTTP/2 extended CONNECT when no http proxy is used,
+	// fallback to HTTP/1.1 upgrade when the server does not support it.
+	HTTP2 bool
+
+	// Compression offer permessage-deflate when dialing websocket tunnels and set the
+	// level and min size of websocket tunnels, accepting it is up to the upgrader of
+	// servers. The ratio is reported in Stats of sessions with it negotiated.
+	Compression ws.Compression
+
+	// UDPIdleTimeout is the idle duration before an udp session expired, default DefaultUDPIdleTimeout.
+	UDPIdleTimeout time.Duration
+
+	// Logger for tunnel events, logging.Default() when nil.
+	Logger logging.Logger
+
+	// Bandwidth throttle the relayed data, up for client -> target and down for the reverse.
+	Bandwidth throttle.Bandwidth
+
+	// TargetProxyHeader is written to stream targets once connected, nil for none.
+	TargetProxyHeader *proxyproto.Header
+
+	// Dialer dial the final hop: stream targets of WS2TCP, Conn2TCP and HTTP2TCP, udp
+	// targets of WS2UDP, and tunnel servers of TCP2Tunnel and TCP2WS, nil for direct
+	// dialing without timeout. Target connections dialed through proxies can have a
+	// TargetAddr() net.Addr method returning the address the target resolved to, nil
+	// when unknown, it is reported in Stats.Resolved instead of RemoteAddr.
+	Dialer netproxy.ContextDialer
+
+	// Balancer choose the backend to dial for stream targets, the target is then only
+	// reported in stats, nil for dialing the target.
+	Balancer Balancer
+
+	// IdleTimeout close a stream session when no payload moved in either direction
+	// for the duration, heartbeats are not counted, 0 for never.
+	IdleTimeout time.Duration
+
+	// MaxDuration close a session lasting for the duration, 0 for never.
+	MaxDuration time.Duration
+
+	// MaxBytes close a session when its payload in both directions reach the bytes, 0 for unlimited.
+	MaxBytes int64
+
+	// OnSessionStart is called when a session start with the target connected, it can be nil.
+	OnSessionStart func(Stats)
+
+	// OnSessionEnd is called with the stats when a session end, it can be nil.
+	OnSessionEnd func(Stats)
 }
 
 // TCP2Tunnel tcp client -> tcp tunnel server(http/https/http2.0 or socket5).
@@ -38,7 +89,7 @@ func (b *Bridge) TCP2Tunnel(src net.Conn, proxyURL string) error {
 		return err
 	}
 
-	proxyDialer, err := netproxy.FromURL(dialProxyURL, netproxy.FromEnvironment())
+	proxyDialer, err := netproxy.FromURL(dialProxyURL, b.forwardDialer())
 	if err != nil {
 		return err
 	}
@@ -49,35 +100,126 @@ func (b *Bridge) TCP2Tunnel(src net.Conn, proxyURL string) error {
 	}
 	defer remoteCon.Close()
 
-	return syncConn(remoteCon, src)
+	s := b.newSession(redactURL(proxyURL), remoteCon.RemoteAddr())
+	s.closeOnStop(remoteCon)
+	s.watch(b.IdleTimeout)
+
+	return s.end(syncConn(remoteCon, s.clientConn(src), b.Logger))
 }
 
-// WS2TCP websocket tunnel -> tcp server
+// WS2TCP websocket tunnel -> tcp server, tcpAddress can be "unix:/path" for unix socket server.
 func (b *Bridge) WS2TCP(src *websocket.Conn, tcpAddress string) error {
-	tcpCon, err := net.Dial("tcp", tcpAddress)
+	if err := b.Compression.Setup(src); err != nil {
+		return err
+	}
+
+	tcpCon, err := b.dialTarget(tcpAddress)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := tcpCon.Close()
+		if err != nil {
+			logging.Or(b.Logger).Log(logging.LevelWarn, "close target connection failed", "from", "ws://"+src.LocalAddr().String(), "target", tcpAddress, "err", err)
+		}
+	}()
+
+	s := b.newSession(tcpAddress, targetAddr(tcpCon))
+	s.version, s.wire = ws.Version(src), wireOf(src)
+	s.closeWSOnStop(src)
+	s.closeOnStop(tcpCon)
+	s.watch(b.IdleTimeout)
+
+	return s.end(syncConn(s.targetConn(tcpCon), ws.NewCompressedWSConn(src, b.Compression, b.HeartInterval, b.Logger), b.Logger))
+}
+
+// Conn2TCP tunnel connection -> tcp server, tcpAddress can be "unix:/path" for unix socket server.
+func (b *Bridge) Conn2TCP(src net.Conn, tcpAddress string) error {
+	tcpCon, err := b.dialTarget(tcpAddress)
 	if err != nil {
-		return errors.Wrapf(err, "dial tcp %s failed", tcpAddress)
+		return err
 	}
 	defer func() {
 		err := tcpCon.Close()
 		if err != nil {
-			log.Printf("[WARN ] connection : ws://%s -> tcp://%s close error %+v\n", src.LocalAddr(), tcpCon.RemoteAddr(), err)
+			logging.Or(b.Logger).Log(logging.LevelWarn, "close target connection failed", "from", src.RemoteAddr().Network()+"://"+src.RemoteAddr().String(), "target", tcpAddress, "err", err)
 		}
 	}()
 
-	return syncConn(tcpCon, ws.NewWSConn(src, b.HeartInterval))
+	s := b.newSession(tcpAddress, targetAddr(tcpCon))
+	s.closeOnStop(tcpCon)
+	s.watch(b.IdleTimeout)
+
+	return s.end(syncConn(s.targetConn(tcpCon), src, b.Logger))
+}
+
+// HTTP2TCP http stream tunnel -> tcp server, request body is the upstream
+// and response body is the downstream, it should be served with HTTP/2.
+// tcpAddress can be "unix:/path" for unix socket server.
+func (b *Bridge) HTTP2TCP(w http.ResponseWriter, r *http.Request, tcpAddress string) error {
+	if _, ok := w.(http.Flusher); !ok {
+		return errors.New("http response writer does not support flushing")
+	}
+
+	tcpCon, err := b.dialTarget(tcpAddress)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := tcpCon.Close()
+		if err != nil {
+			logging.Or(b.Logger).Log(logging.LevelWarn, "close target connection failed", "from", "http://"+r.RemoteAddr, "target", tcpAddress, "err", err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	var local net.Addr = post.StreamAddr{Net: "h2"}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		local = addr
+	}
+	remote := post.StreamAddr{Net: "h2", Addr: r.RemoteAddr}
+
+	s := b.newSession(tcpAddress, targetAddr(tcpCon))
+	s.closeOnStop(tcpCon)
+	s.watch(b.IdleTimeout)
+
+	return s.end(syncConn(s.targetConn(tcpCon), post.NewStreamConn(r.Body, post.NewFlushWriter(w), local, remote), b.Logger))
 }
 
 // TCP2WS tcp client -> websocket tunnel
 func (b *Bridge) TCP2WS(src net.Conn, wsURL string) error {
+	wsCon, wire, err := b.dialTunnelWS(wsURL)
+	if err != nil {
+		return err
+	}
+	defer wsCon.Close()
+
+	s := b.newSession(redactURL(wsURL), wsCon.RemoteAddr())
+	s.version, s.wire = ws.Version(wsCon), wire
+	s.closeWSOnStop(wsCon)
+	s.watch(b.IdleTimeout)
+
+	return s.end(ws.SyncCompressedConn(wsCon, s.clientConn(src), b.Compression, b.HeartInterval, b.Logger))
+}
+
+// dialTunnelWS dial the websocket tunnel server, the wire connection is returned
+// for compression stats when permessage-deflate is negotiated, nil otherwise.
+func (b *Bridge) dialTunnelWS(wsURL string) (*websocket.Conn, *ws.WireConn, error) {
 	wsDialer := &websocket.Dialer{
-		Proxy:            b.WSProxyGetter,
-		HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+		Proxy:             b.WSProxyGetter,
+		HandshakeTimeout:  websocket.DefaultDialer.HandshakeTimeout,
+		EnableCompression: b.Compression.Enabled,
+		Subprotocols:      ws.Protocols,
+	}
+	if b.Dialer != nil {
+		wsDialer.NetDial = b.dial
 	}
 
 	u, err := url.Parse(wsURL)
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, nil, errors.WithStack(err)
 	}
 
 	// set auth.
@@ -89,16 +231,93 @@ func (b *Bridge) TCP2WS(src net.Conn, wsURL string) error {
 		u.User = nil
 	}
 
-	wsCon, _, err := wsDialer.Dial(u.String(), wsHeader)
+	wsCon, wire, err := b.dialWS(wsDialer, u, wsHeader)
 	if err != nil {
-		return errors.Wrapf(err, "dial ws %s failed", wsURL)
+		return nil, nil, errors.Wrapf(err, "dial ws %s failed", wsURL)
+	}
+	if err := b.Compression.Setup(wsCon); err != nil {
+		wsCon.Close()
+		return nil, nil, err
+	}
+
+	logging.Or(b.Logger).Log(logging.LevelDebug, "websocket tunnel dialed", "url", redactURL(wsURL), "protocol", ws.Version(wsCon))
+
+	return wsCon, wire, nil
+}
+
+func (b *Bridge) dialWS(wsDialer *websocket.Dialer, u *url.URL, wsHeader http.Header) (*websocket.Conn, *ws.WireConn, error) {
+	if b.HTTP2 && u.Scheme == "wss" && !b.viaHTTPProxy(u) {
+		// streams share the http/2 connection, the wire bytes of a tunnel are unknown.
+		wsCon, err := ws.DialH2(wsDialer, b.tunnelDialer(), u.String(), wsHeader)
+		if err == nil {
+			return wsCon, nil, nil
+		}
+		if !errors.Is(err, ws.ErrExtendedConnectUnsupported) {
+			return nil, nil, err
+		}
+		logging.Or(b.Logger).Log(logging.LevelInfo, "fallback to http/1.1 upgrade", "url", u, "err", err)
+	}
+
+	var wire *ws.WireConn
+	if b.Compression.Enabled {
+		d := *wsDialer
+		netDial := d.NetDial
+		if netDial == nil {
+			netDial = (&net.Dialer{Timeout: d.HandshakeTimeout}).Dial
+		}
+		d.NetDial = func(network, addr string) (net.Conn, error) {
+			c, err := netDial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			wire = ws.NewWireConn(c)
+			return wire, nil
+		}
+		wsDialer = &d
+	}
+
+	wsCon, resp, err := wsDialer.Dial(u.String(), wsHeader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ws.Negotiated(resp.Header) {
+		wire = nil
+	}
+
+	return wsCon, wire, nil
+}
+
+// throttleClient throttle the client side connection: reading is up and writing is down.
+func (b *Bridge) throttleClient(c net.Conn) net.Conn {
+	return throttle.NewConn(c, b.Bandwidth.Up, b.Bandwidth.Down)
+}
+
+// throttleTarget throttle the target side connection: writing is up and reading is down.
+func (b *Bridge) throttleTarget(c net.Conn) net.Conn {
+	return throttle.NewConn(c, b.Bandwidth.Down, b.Bandwidth.Up)
+}
+
+// viaHTTPProxy report whether the websocket connection to u goes through a http proxy.
+func (b *Bridge) viaHTTPProxy(u *url.URL) bool {
+	if b.WSProxyGetter == nil {
+		return false
+	}
+
+	proxyURL, err := b.WSProxyGetter(&http.Request{URL: &url.URL{Scheme: "https", Host: u.Host}})
+	return err != nil || proxyURL != nil
+}
+
+// redactURL return rawURL with password masked for reporting.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
 	}
-	defer wsCon.Close()
 
-	return ws.SyncConn(wsCon, src, b.HeartInterval)
+	return u.Redacted()
 }
 
-func syncConn(a, b net.Conn) (err error) {
+func syncConn(a, b net.Conn, logger logging.Logger) (err error) {
 	errCh1 := make(chan error)
 	errCh2 := make(chan error)
 
@@ -113,9 +332,9 @@ func syncConn(a, b net.Conn) (err error) {
 
 	select {
 	case err = <-errCh1:
-		log.Printf("[WARN ] disconnected: tcp://%s -> tcp://%s %+v\n", a.LocalAddr(), b.RemoteAddr(), err)
+		logging.Or(logger).Log(logging.LevelWarn, "disconnected", "from", a.LocalAddr(), "to", b.RemoteAddr(), "err", err)
 	case err = <-errCh2:
-		log.Printf("[WARN ] disconnected: tcp://%s -> tcp://%s %+v\n", b.LocalAddr(), a.RemoteAddr(), err)
+		logging.Or(logger).Log(logging.LevelWarn, "disconnected", "from", b.LocalAddr(), "to", a.RemoteAddr(), "err", err)
 	}
 
 	return err
@@ -0,0 +1,141 @@
+// Package throttle implement token bucket bandwidth shaping for tunnel sessions.
+package throttle
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket of bytes, it can be shared by many connections to
+// aggregate their bandwidth, and the rate can be changed at any time.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second, 0 for unlimited.
+	tokens float64 // negative when borrowed, callers wait until it is paid back.
+	last   time.Time
+}
+
+// NewLimiter return a limiter allow rate bytes per second with a burst of one second, 0 for unlimited.
+func NewLimiter(rate int64) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate)
+
+	return l
+}
+
+// Rate return the bytes per second allowed, 0 for unlimited.
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int64(l.rate)
+}
+
+// SetRate change the bytes per second allowed, 0 for unlimited.
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rate < 0 {
+		rate = 0
+	}
+	l.rate = float64(rate)
+	l.tokens = l.rate
+	l.last = time.Now()
+}
+
+// WaitN block until n bytes are allowed, a nil limiter never blocks.
+func (l *Limiter) WaitN(n int) {
+	if wait := l.reserve(n); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// reserve take n bytes and return the duration to wait before using them.
+func (l *Limiter) reserve(n int) time.Duration {
+	if l == nil || n <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate // burst of one second.
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Limiters is a set of limiters applied together, nil items are ignored.
+type Limiters []*Limiter
+
+// WaitN block until n bytes are allowed by all limiters.
+func (ls Limiters) WaitN(n int) {
+	var wait time.Duration
+	for _, l := range ls {
+		if d := l.reserve(n); d > wait {
+			wait = d
+		}
+	}
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Bandwidth is the limiters of a session: Up for data from client to target, Down for the reverse.
+type Bandwidth struct {
+	Up   Limiters
+	Down Limiters
+}
+
+// IsZero report whether no limiter is set.
+func (b Bandwidth) IsZero() bool {
+	return len(b.Up) == 0 && len(b.Down) == 0
+}
+
+// NewConn return a connection throttled by read limiters on read and write limiters on write.
+func NewConn(c net.Conn, read, write Limiters) net.Conn {
+	if len(read) == 0 && len(write) == 0 {
+		return c
+	}
+
+	return &conn{Conn: c, read: read, write: write}
+}
+
+type conn struct {
+	net.Conn
+	read  Limiters
+	write Limiters
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.WaitN(n)
+
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	c.write.WaitN(len(b))
+
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,102 @@
+package throttle
+
+import "sync"
+
+// Rates are bandwidth limits in bytes per second, 0 for unlimited.
+type Rates struct {
+	SessionUp   int64 `json:"session_up"`   // every session, client to target.
+	SessionDown int64 `json:"session_down"` // every session, target to client.
+	SharedUp    int64 `json:"shared_up"`    // aggregated by key(user or listener), client to target.
+	SharedDown  int64 `json:"shared_down"`  // aggregated by key(user or listener), target to client.
+}
+
+// Policy create limiters for sessions by rates, the rates can be changed at
+// runtime and apply to live sessions too.
+type Policy struct {
+	mu       sync.Mutex
+	rates    Rates
+	shared   map[string]*sharedLimiters
+	sessions map[*sessionLimiters]struct{}
+}
+
+type sharedLimiters struct {
+	up, down *Limiter
+	refs     int
+}
+
+type sessionLimiters struct {
+	up, down *Limiter
+}
+
+// NewPolicy return a policy with rates.
+func NewPolicy(rates Rates) *Policy {
+	return &Policy{
+		rates:    rates,
+		shared:   make(map[string]*sharedLimiters),
+		sessions: make(map[*sessionLimiters]struct{}),
+	}
+}
+
+// Rates return the current rates.
+func (p *Policy) Rates() Rates {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.rates
+}
+
+// SetRates change rates of new and live sessions.
+func (p *Policy) SetRates(rates Rates) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.rates = rates
+	for s := range p.sessions {
+		s.up.SetRate(rates.SessionUp)
+		s.down.SetRate(rates.SessionDown)
+	}
+	for _, s := range p.shared {
+		s.up.SetRate(rates.SharedUp)
+		s.down.SetRate(rates.SharedDown)
+	}
+}
+
+// Session return the bandwidth of a new session which is aggregated with other
+// sessions of the same key, empty key for not aggregated. release should be
+// called when the session end.
+func (p *Policy) Session(key string) (Bandwidth, func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := &sessionLimiters{up: NewLimiter(p.rates.SessionUp), down: NewLimiter(p.rates.SessionDown)}
+	p.sessions[s] = struct{}{}
+	bw := Bandwidth{Up: Limiters{s.up}, Down: Limiters{s.down}}
+
+	if key != "" {
+		shared, ok := p.shared[key]
+		if !ok {
+			shared = &sharedLimiters{up: NewLimiter(p.rates.SharedUp), down: NewLimiter(p.rates.SharedDown)}
+			p.shared[key] = shared
+		}
+		shared.refs++
+		bw.Up = append(bw.Up, shared.up)
+		bw.Down = append(bw.Down, shared.down)
+	}
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+
+			delete(p.sessions, s)
+			if shared, ok := p.shared[key]; ok {
+				if shared.refs--; shared.refs <= 0 {
+					delete(p.shared, key)
+				}
+			}
+		})
+	}
+
+	return bw, release
+}
@@ -0,0 +1,222 @@
+package tcpb
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wuhuizuo/tcpb/logging"
+	ws "github.com/wuhuizuo/tcpb/proxy/websocket"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultUDPIdleTimeout is the default idle duration before an udp session expired.
+	DefaultUDPIdleTimeout = 60 * time.Second
+
+	datagramLen = 65535
+	udpQueueLen = 64
+)
+
+var errPeerClosed = errors.New("udp peer closed")
+
+// WS2UDP websocket tunnel -> udp server, every websocket message is a datagram.
+func (b *Bridge) WS2UDP(src *websocket.Conn, udpAddress string) error {
+	udpCon, err := b.dial("udp", udpAddress)
+	if err != nil {
+		return errors.Wrapf(err, "dial udp %s failed", udpAddress)
+	}
+	defer udpCon.Close()
+
+	if err := b.Compression.Setup(src); err != nil {
+		return err
+	}
+	wsCon := ws.NewCompressedDatagramConn(src, b.Compression, b.HeartInterval, b.Logger)
+	defer wsCon.Close()
+
+	s := b.newSession(udpAddress, targetAddr(udpCon))
+	s.version, s.wire = ws.Version(src), wireOf(src)
+	s.closeWSOnStop(src)
+	s.watch(b.udpIdleTimeout())
+
+	return relayDatagram(s, s.targetConn(udpCon), wsCon)
+}
+
+// ServeUDP forward udp datagrams from pc to the websocket tunnel, every source
+// address has its own tunnel session which expires after idle timeout.
+func (b *Bridge) ServeUDP(pc net.PacketConn, wsURL string) error {
+	if !strings.HasPrefix(wsURL, "ws://") && !strings.HasPrefix(wsURL, "wss://") {
+		return errors.Errorf("udp forwarding only supported with websocket tunnel: %s", wsURL)
+	}
+
+	var (
+		mu       sync.Mutex
+		sessions = make(map[string]*udpSource)
+		start    func(addr net.Addr) *udpSource
+	)
+
+	// start open the session of addr with mu held. Datagrams queued but not relayed
+	// when the session end are moved to a new session, unless the tunnel was never dialed.
+	start = func(addr net.Addr) *udpSource {
+		key := addr.String()
+		src := &udpSource{queue: make(chan []byte, udpQueueLen)}
+		sessions[key] = src
+
+		go func() {
+			logger := logging.Or(b.Logger)
+			logger.Log(logging.LevelInfo, "udp session started", "source", key)
+			dialed, err := b.udpSession(pc, addr, src.queue, wsURL)
+			if err != nil {
+				logger.Log(logging.LevelWarn, "udp session closed", "source", key, "err", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			src.closed = true
+			if sessions[key] == src {
+				delete(sessions, key)
+			}
+			if dialed && len(src.queue) > 0 {
+				next := start(addr)
+				for len(src.queue) > 0 {
+					next.queue <- <-src.queue
+				}
+			}
+		}()
+
+		return src
+	}
+
+	buf := make([]byte, datagramLen)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		src, ok := sessions[addr.String()]
+		if !ok || src.closed {
+			src = start(addr)
+		}
+		select {
+		case src.queue <- append([]byte(nil), buf[:n]...):
+		default:
+			// drop datagram like udp when the tunnel is congested.
+		}
+		mu.Unlock()
+	}
+}
+
+// udpSource is the datagram queue of a source address, closed is set with the
+// lock of sessions once its session stop relaying.
+type udpSource struct {
+	queue  chan []byte
+	closed bool
+}
+
+// udpSession relay datagrams of one source address over a websocket tunnel, it
+// reports whether the tunnel was dialed.
+func (b *Bridge) udpSession(pc net.PacketConn, addr net.Addr, queue <-chan []byte, wsURL string) (bool, error) {
+	wsCon, wire, err := b.dialTunnelWS(wsURL)
+	if err != nil {
+		return false, err
+	}
+	tunnel := ws.NewCompressedDatagramConn(wsCon, b.Compression, b.HeartInterval, b.Logger)
+	defer tunnel.Close()
+
+	peer := &packetPeer{pc: pc, addr: addr, queue: queue, closed: make(chan struct{})}
+	s := b.newSession(redactURL(wsURL), wsCon.RemoteAddr())
+	s.version, s.wire = ws.Version(wsCon), wire
+	s.closeWSOnStop(wsCon)
+	s.watch(b.udpIdleTimeout())
+
+	return true, relayDatagram(s, s.clientConn(peer), tunnel)
+}
+
+func (b *Bridge) udpIdleTimeout() time.Duration {
+	if b.UDPIdleTimeout > 0 {
+		return b.UDPIdleTimeout
+	}
+
+	return DefaultUDPIdleTimeout
+}
+
+// relayDatagram copy datagrams between a and b until error or the session stopped.
+func relayDatagram(s *session, a, b net.Conn) error {
+	s.closeOnStop(a)
+	s.closeOnStop(b)
+
+	copyFn := func(dst, src net.Conn) error {
+		buf := make([]byte, datagramLen)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				return err
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+	}
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- copyFn(a, b) }()
+	go func() { errCh <- copyFn(b, a) }()
+
+	err := <-errCh
+	_ = a.Close()
+	_ = b.Close()
+
+	return s.end(err)
+}
+
+// packetPeer wrap a source address of net.PacketConn as net.Conn.
+type packetPeer struct {
+	pc    net.PacketConn
+	addr  net.Addr
+	queue <-chan []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Read implement net.Conn, it returns datagram queued from the source address.
+func (p *packetPeer) Read(b []byte) (int, error) {
+	select {
+	case data := <-p.queue:
+		return copy(b, data), nil
+	case <-p.closed:
+		return 0, errPeerClosed
+	}
+}
+
+// Write implement net.Conn, it sends datagram to the source address.
+func (p *packetPeer) Write(b []byte) (int, error) {
+	return p.pc.WriteTo(b, p.addr)
+}
+
+// Close implement net.Conn, the shared net.PacketConn keeps open.
+func (p *packetPeer) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return nil
+}
+
+// LocalAddr implement net.Conn.
+func (p *packetPeer) LocalAddr() net.Addr { return p.pc.LocalAddr() }
+
+// RemoteAddr implement net.Conn.
+func (p *packetPeer) RemoteAddr() net.Addr { return p.addr }
+
+// SetDeadline implement net.Conn, it does nothing.
+func (p *packetPeer) SetDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline implement net.Conn, it does nothing.
+func (p *packetPeer) SetReadDeadline(t time.Time) error { return nil }
+
+// SetWriteDeadline implement net.Conn, it does nothing.
+func (p *packetPeer) SetWriteDeadline(t time.Time) error { return nil }